@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// assetsDir is the output directory for fingerprinted copies of static/.
+	assetsDir = "assets"
+	// assetManifestFile is written to the output root, mapping each static
+	// file to the URL of its fingerprinted copy.
+	assetManifestFile = "asset-manifest.json"
+	// fingerprintLen is the number of hex characters of the content hash
+	// included in fingerprinted file names.
+	fingerprintLen = 10
+)
+
+// assetManifest maps a slash-separated path relative to static/ (e.g.
+// "favicon.svg") to the URL path of its fingerprinted copy (e.g.
+// "/assets/favicon.0123456789.svg").
+type assetManifest map[string]string
+
+// unfingerprintedName returns a fingerprinted file name as it was before the
+// content hash was inserted, e.g. "feed.xml" for "feed.0123456789.xml".
+// Other names are returned as they are.
+func unfingerprintedName(name string) string {
+	isHash := func(ext string) bool {
+		if len(ext) != 1+fingerprintLen {
+			return false
+		}
+		_, err := hex.DecodeString(ext[1:])
+		return err == nil && strings.ToLower(ext) == ext
+	}
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	switch {
+	case isHash(ext):
+		// A file without an extension gets the hash at the end
+		return base
+	case isHash(path.Ext(base)):
+		return strings.TrimSuffix(base, path.Ext(base)) + ext
+	}
+	return name
+}
+
+// buildStatic copies every file under srcDir to outDir/static under its own
+// name, and to outDir/assets with a content hash inserted before the
+// extension. Files are minified first if minifier is non-nil, so the hash covers
+// the content actually served. The manifest is written to outDir.
+func buildStatic(srcDir, outDir string, minifier *siteMinifier) (assetManifest, error) {
+	staticDir := filepath.Join(outDir, "static")
+	dstDir := filepath.Join(outDir, assetsDir)
+	// Start clean so the build only holds current files. Sync keeps earlier
+	// fingerprinted assets in the bucket unless told to prune them.
+	for _, dir := range []string{staticDir, dstDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to clean %s: %w", dir, err)
+		}
+	}
+
+	manifest := make(assetManifest)
+	err := filepath.WalkDir(srcDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(srcDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		data, err = minifier.file(name, data)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(staticDir, relPath), data); err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:fingerprintLen]
+
+		ext := path.Ext(name)
+		fpName := strings.TrimSuffix(name, ext) + "." + hash + ext
+
+		if err := writeFile(filepath.Join(dstDir, filepath.FromSlash(fpName)), data); err != nil {
+			return err
+		}
+
+		manifest[name] = "/" + assetsDir + "/" + fpName
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(outDir, assetManifestFile), manifestJSON, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write asset manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// writeFile writes data to p, creating parent directories as needed.
+func writeFile(p string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// url returns the fingerprinted URL for a file under static/. It is exposed to
+// templates as the "asset" function, so a missing asset fails the build.
+func (m assetManifest) url(name string) (string, error) {
+	u, ok := m[strings.TrimPrefix(name, "/")]
+	if !ok {
+		return "", fmt.Errorf("unknown asset %q", name)
+	}
+	return u, nil
+}
+
+// loadFingerprintedKeys returns the object keys of the fingerprinted assets
+// listed in the manifest in dir. A missing manifest yields no keys.
+func loadFingerprintedKeys(dir string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+
+	data, err := os.ReadFile(filepath.Join(dir, assetManifestFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return keys, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read asset manifest: %w", err)
+	}
+
+	var manifest assetManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse asset manifest: %w", err)
+	}
+	for _, u := range manifest {
+		keys[strings.TrimPrefix(u, "/")] = true
+	}
+	return keys, nil
+}
@@ -28,7 +28,7 @@ func addAWSAuthFlags(fs *flag.FlagSet) *AWSAuthConfig {
 	fs.StringVar(&c.Issuer, "oidc-issuer", "https://id.lds.li", "OIDC Issuer URL")
 	fs.StringVar(&c.ClientID, "oidc-client-id", "sts.amazonaws.com", "OIDC Client ID")
 	fs.StringVar(&c.ClientSecret, "oidc-client-secret", "public", "OIDC Client Secret")
-	fs.StringVar(&c.RoleARN, "aws-role-arn", "arn:aws:iam::041050768191:role/lstoll-admin", "AWS Role ARN")
+	fs.StringVar(&c.RoleARN, "aws-role-arn", "", "AWS Role ARN to assume via OIDC (default credential chain if empty)")
 	fs.StringVar(&c.Region, "aws-region", "us-east-1", "AWS Region")
 	return c
 }
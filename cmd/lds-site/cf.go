@@ -2,11 +2,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log/slog"
-	"os"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -14,21 +12,47 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 )
 
-func runCF(ctx context.Context, logger *slog.Logger, args []string) {
-	if len(args) < 1 {
-		logger.Error("Subcommand required: deploy, test")
-		os.Exit(1)
-	}
+var cfCommand = &command{
+	name:        "cf",
+	summary:     "Manage CloudFront functions",
+	subcommands: []*command{cfDeployCommand, cfTestCommand},
+}
 
-	switch args[0] {
-	case "deploy":
-		runCFDeploy(ctx, logger, args[1:])
-	case "test":
-		runCFTest(ctx, logger, args[1:])
-	default:
-		logger.Error("Unknown subcommand", "command", args[0])
-		os.Exit(1)
-	}
+var cfDeployCommand = &command{
+	name:    "deploy",
+	summary: "Render, test and publish the CloudFront function",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		opts := addCFDeployFlags(fs)
+		awsAuth := addAWSAuthFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			cfg, err := awsAuth.Load(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load AWS config: %w", err)
+			}
+			return doCFDeploy(ctx, logger, cfg, site, opts)
+		}
+	},
+}
+
+var cfTestCommand = &command{
+	name:    "test",
+	summary: "Run the test suite against the function's DEVELOPMENT stage, or locally",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		functionARN := fs.String("function-arn", "", "CloudFront Function Name or ARN (must exist)")
+		local := fs.Bool("local", false, "Run the tests offline against the rendered function, with an in-memory KeyValueStore")
+		minify := fs.Bool("minify-function", true, "Minify the function code for local runs, as deploy does")
+		kvs := addKVSFlags(fs)
+		tests := addFunctionTestFlags(fs)
+		awsAuth := addAWSAuthFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			if *local {
+				return runCFTestLocal(ctx, logger, site, renderOptions{Minify: *minify}, kvs, tests)
+			}
+			return runCFTest(ctx, logger, site, *functionARN, tests, awsAuth)
+		}
+	},
 }
 
 func getFunctionName(input string) string {
@@ -45,93 +69,62 @@ func getFunctionName(input string) string {
 	return input // Assume it's already the name
 }
 
-func runCFDeploy(ctx context.Context, logger *slog.Logger, args []string) {
-	fs := flag.NewFlagSet("cf deploy", flag.ExitOnError)
-	nameInput := fs.String("function-arn", "", "CloudFront Function Name or ARN (must exist)")
-	stage := fs.String("stage", "LIVE", "Stage (DEVELOPMENT or LIVE)")
-	emailAddr := fs.String("email", os.Getenv("EMAIL_ADDRESS"), "Email address")
-	configFile := fs.String("config", "site.yaml", "Site configuration file")
-	runTests := fs.Bool("test", true, "Run tests after updating development stage")
-
-	awsAuth := addAWSAuthFlags(fs)
-
-	fs.Parse(args)
-
-	if err := parseEnvFlags(fs); err != nil {
-		logger.Error("Failed to parse env flags", "error", err)
-		os.Exit(1)
-	}
-
-	cfg, err := awsAuth.Load(ctx)
-	if err != nil {
-		logger.Error("Failed to load AWS config", "error", err)
-		os.Exit(1)
-	}
-
-	if err := doCFDeploy(ctx, logger, cfg, *nameInput, *stage, *emailAddr, *configFile, *runTests); err != nil {
-		logger.Error("Deploy failed", "error", err)
-		os.Exit(1)
-	}
-}
-
-func doCFDeploy(ctx context.Context, logger *slog.Logger, cfg aws.Config, nameInput, stage, emailAddr, configFile string, runTests bool) error {
-	// Better check empty string before calling if possible, but here:
-	if nameInput == "" {
+func doCFDeploy(ctx context.Context, logger *slog.Logger, cfg aws.Config, site *siteOptions, opts *cfDeployOptions) error {
+	if opts.FunctionARN == "" {
 		return fmt.Errorf("function name or ARN is required")
 	}
-	if emailAddr == "" {
+	if site.Email == "" {
 		return fmt.Errorf("email is required")
 	}
+	emailAddr := site.Email
 
-	siteCfg, err := LoadConfig(configFile)
+	siteCfg, err := site.loadConfig()
 	if err != nil {
-		return fmt.Errorf("failed to load site config: %w", err)
+		return err
 	}
 
-	functionName := getFunctionName(nameInput)
+	functionName := getFunctionName(opts.FunctionARN)
 
-	// Prepare Code
-	modJSON, _ := json.Marshal(siteCfg.Modules)
-	
-	// Process Webfinger: replace %%EMAIL%% key with actual email
-	processedWebfinger := make(map[string][]WebfingerLink)
-	for k, v := range siteCfg.Webfinger {
-		if k == "%%EMAIL%%" {
-			processedWebfinger[emailAddr] = v
-		} else {
-			processedWebfinger[k] = v
+	var tests []TestCase
+	if opts.RunTests {
+		// Load tests up front so a bad test file fails before anything changes
+		tests, err = functionTests(siteCfg, emailAddr, opts.Tests)
+		if err != nil {
+			return err
 		}
 	}
-	wfJSON, _ := json.Marshal(processedWebfinger)
 
-	// Read template
-	tmplContent, err := os.ReadFile("cmd/lds-site/function.tmpl.js")
+	renderOpts := renderOptions{Minify: opts.MinifyFunction}
+	if opts.KVS.ARN != "" {
+		renderOpts.KVSID = kvsIDFromARN(opts.KVS.ARN)
+	}
+	rendered, err := renderFunction(siteCfg, emailAddr, renderOpts)
 	if err != nil {
-		return fmt.Errorf("failed to read function template: %w", err)
+		return err
 	}
-
-	codeStr := string(tmplContent)
-
-	// Generate vars block
-	var sb strings.Builder
-	sb.WriteString("/* START VARS */\n")
-	sb.WriteString(fmt.Sprintf("var moduleRegistry = %s;\n", string(modJSON)))
-	sb.WriteString(fmt.Sprintf("var webfingerRegistry = %s;\n", string(wfJSON)))
-	sb.WriteString(fmt.Sprintf("var email = \"%s\";\n", emailAddr))
-	sb.WriteString(fmt.Sprintf("var canonicalHost = \"%s\";\n", siteCfg.CanonicalHost))
-	sb.WriteString("/* END VARS */")
-
-	// Replace the block
-	startMarker := "/* START VARS */"
-	endMarker := "/* END VARS */"
-	startIndex := strings.Index(codeStr, startMarker)
-	endIndex := strings.Index(codeStr, endMarker)
-
-	if startIndex == -1 || endIndex == -1 || startIndex >= endIndex {
-		return fmt.Errorf("failed to find vars block in template")
+	sizeArgs := []any{"size", len(rendered.Code), "limit", maxFunctionSize}
+	for _, s := range rendered.Sections {
+		sizeArgs = append(sizeArgs, s.Name, s.Size)
+	}
+	logger.Info("Rendered function", sizeArgs...)
+	// CloudFront only rejects oversized code at UpdateFunction, so fail first
+	if err := rendered.checkSize(); err != nil {
+		return err
 	}
 
-	functionCode := []byte(codeStr[:startIndex] + sb.String() + codeStr[endIndex+len(endMarker):])
+	// LIVE reads the same store, so by default it only changes once the
+	// tests have passed
+	syncKVS := func() error {
+		if err := doKVSSync(ctx, logger, cfg, siteCfg, emailAddr, opts.KVS, false); err != nil {
+			return fmt.Errorf("failed to sync KeyValueStore: %w", err)
+		}
+		return nil
+	}
+	if opts.KVS.ARN != "" && opts.SyncKVSFirst {
+		if err := syncKVS(); err != nil {
+			return err
+		}
+	}
 
 	client := cloudfront.NewFromConfig(cfg)
 
@@ -149,11 +142,21 @@ func doCFDeploy(ctx context.Context, logger *slog.Logger, cfg aws.Config, nameIn
 	etag := descOut.ETag
 	logger.Info("Function exists, updating", "etag", *etag)
 
+	functionConfig := *descOut.FunctionSummary.FunctionConfig
+	functionConfig.Runtime = functionRuntime
+	functionConfig.KeyValueStoreAssociations = nil
+	if opts.KVS.ARN != "" {
+		functionConfig.KeyValueStoreAssociations = &types.KeyValueStoreAssociations{
+			Quantity: aws.Int32(1),
+			Items:    []types.KeyValueStoreAssociation{{KeyValueStoreARN: aws.String(opts.KVS.ARN)}},
+		}
+	}
+
 	updateOut, err := client.UpdateFunction(ctx, &cloudfront.UpdateFunctionInput{
 		Name:           &functionName,
 		IfMatch:        etag,
-		FunctionConfig: descOut.FunctionSummary.FunctionConfig,
-		FunctionCode:   functionCode,
+		FunctionConfig: &functionConfig,
+		FunctionCode:   rendered.Code,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to update function: %w", err)
@@ -162,15 +165,23 @@ func doCFDeploy(ctx context.Context, logger *slog.Logger, cfg aws.Config, nameIn
 
 	logger.Info("Function updated in DEVELOPMENT")
 
-	if runTests {
+	if opts.RunTests {
 		logger.Info("Running tests against DEVELOPMENT stage")
-		if err := RunTests(ctx, client, functionName, *etag, emailAddr, logger); err != nil {
+		if err := RunTests(ctx, client, functionName, *etag, tests, opts.Tests, logger); err != nil {
 			return fmt.Errorf("tests failed, aborting deployment: %w", err)
 		}
 		logger.Info("Tests passed")
 	}
 
-	if stage == "LIVE" {
+	if opts.KVS.ARN != "" && !opts.SyncKVSFirst {
+		if opts.Stage != "LIVE" {
+			logger.Info("KeyValueStore left unchanged for a DEVELOPMENT deploy, run kvs sync to update it")
+		} else if err := syncKVS(); err != nil {
+			return err
+		}
+	}
+
+	if opts.Stage == "LIVE" {
 		logger.Info("Publishing function to LIVE")
 		_, err = client.PublishFunction(ctx, &cloudfront.PublishFunctionInput{
 			Name:    &functionName,
@@ -184,36 +195,28 @@ func doCFDeploy(ctx context.Context, logger *slog.Logger, cfg aws.Config, nameIn
 	return nil
 }
 
-func runCFTest(ctx context.Context, logger *slog.Logger, args []string) {
-	fs := flag.NewFlagSet("cf test", flag.ExitOnError)
-	nameInput := fs.String("function-arn", "", "CloudFront Function Name or ARN (must exist)")
-	emailAddr := fs.String("email", os.Getenv("EMAIL_ADDRESS"), "Email address")
-
-	awsAuth := addAWSAuthFlags(fs)
-
-	fs.Parse(args)
-
-	if err := parseEnvFlags(fs); err != nil {
-		logger.Error("Failed to parse env flags", "error", err)
-		os.Exit(1)
+func runCFTest(ctx context.Context, logger *slog.Logger, site *siteOptions, nameInput string, testOpts *functionTestOptions, awsAuth *AWSAuthConfig) error {
+	if nameInput == "" {
+		return fmt.Errorf("function name or ARN is required")
 	}
-
-	if *nameInput == "" {
-		logger.Error("Function name or ARN is required")
-		os.Exit(1)
+	if site.Email == "" {
+		return fmt.Errorf("email address is required")
 	}
 
-	if *emailAddr == "" {
-		logger.Error("Email address is required")
-		os.Exit(1)
+	siteCfg, err := site.loadConfig()
+	if err != nil {
+		return err
+	}
+	tests, err := functionTests(siteCfg, site.Email, testOpts)
+	if err != nil {
+		return err
 	}
 
-	functionName := getFunctionName(*nameInput)
+	functionName := getFunctionName(nameInput)
 
 	cfg, err := awsAuth.Load(ctx)
 	if err != nil {
-		logger.Error("Failed to load AWS config", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	client := cloudfront.NewFromConfig(cfg)
@@ -225,12 +228,56 @@ func runCFTest(ctx context.Context, logger *slog.Logger, args []string) {
 		Stage: types.FunctionStage("DEVELOPMENT"),
 	})
 	if err != nil {
-		logger.Error("Failed to describe function. Ensure the function exists and you have permissions.", "name", functionName, "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to describe function %s, ensure it exists and you have permissions: %w", functionName, err)
+	}
+
+	return RunTests(ctx, client, functionName, *descOut.ETag, tests, testOpts, logger)
+}
+
+// runCFTestLocal runs the tests against the function as it would be deployed,
+// without AWS, along with the HostileSuite. It fails if the function is too
+// big to deploy. If a KeyValueStore is configured
+// the registries are served from an in-memory copy of what kvs sync would push.
+func runCFTestLocal(ctx context.Context, logger *slog.Logger, site *siteOptions, renderOpts renderOptions, kvs *kvsOptions, testOpts *functionTestOptions) error {
+	if site.Email == "" {
+		return fmt.Errorf("email address is required")
+	}
+
+	siteCfg, err := site.loadConfig()
+	if err != nil {
+		return err
+	}
+	tests, err := functionTests(siteCfg, site.Email, testOpts)
+	if err != nil {
+		return err
+	}
+	if kvs.ARN != "" {
+		renderOpts.KVSID = kvsIDFromARN(kvs.ARN)
+	}
+	// Size the code deploy would upload, before the test config is added
+	rendered, err := renderFunction(siteCfg, site.Email, renderOpts)
+	if err != nil {
+		return err
+	}
+	if err := rendered.checkSize(); err != nil {
+		return err
 	}
 
-	if err := RunTests(ctx, client, functionName, *descOut.ETag, *emailAddr, logger); err != nil {
-		logger.Error("Tests failed", "error", err)
-		os.Exit(1)
+	// Config can't be made hostile on disk, so add the cases for escaping here
+	siteCfg, hostileTests := HostileSuite(siteCfg)
+	tests = append(tests, hostileTests...)
+
+	var entries map[string]string
+	if kvs.ARN != "" {
+		entries, err = kvsEntries(siteCfg, site.Email)
+		if err != nil {
+			return err
+		}
+	}
+	rendered, err = renderFunction(siteCfg, site.Email, renderOpts)
+	if err != nil {
+		return err
 	}
+
+	return RunLocalTests(ctx, rendered.Code, entries, tests, testOpts, logger)
 }
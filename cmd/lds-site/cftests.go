@@ -5,30 +5,34 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"maps"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
 )
 
-const testCanonicalSite = "lds.li"
-
 // TestCase defines a single test scenario
 type TestCase struct {
-	Name        string
-	Request     Request
-	Validator   func(response Response) error
-	Description string
+	Name        string  `yaml:"name"`
+	Request     Request `yaml:"request"`
+	Expect      Expect  `yaml:"expect"`
+	Description string  `yaml:"description"`
+	// MaxUtilization is the compute utilization budget for this case, in
+	// percent. Zero uses the suite-wide budget.
+	MaxUtilization int `yaml:"max_utilization"`
 }
 
 // Request models the CloudFront function event request
 type Request struct {
-	URI         string
-	Host        string
-	Method      string
-	Querystring map[string]string
-	Headers     map[string]string // Additional headers
+	URI         string            `yaml:"uri"`
+	Host        string            `yaml:"host"`
+	Method      string            `yaml:"method"`
+	Querystring map[string]string `yaml:"querystring"`
+	Headers     map[string]string `yaml:"headers"` // Additional headers
+	Cookies     map[string]string `yaml:"cookies"`
 }
 
 // Response models the CloudFront function output (inner object)
@@ -56,217 +60,551 @@ type Body struct {
 	Data     string `json:"data"`
 }
 
-// Suite returns the list of tests to run
-func Suite(email string) []TestCase {
-	return []TestCase{
+// Suite returns the tests derived from the site config: canonical host
+// handling, every webfinger account, every module, pre-compressed variants and
+// every alias host.
+func Suite(cfg *SiteConfig, email string) []TestCase {
+	host := cfg.CanonicalHost
+	tests := []TestCase{
 		{
 			Name: "Canonical Host Redirect",
 			Request: Request{
 				URI:  "/foo",
-				Host: "non-canonical.example.com", // Assume canonicalHost is lds.li
-			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 301 {
-					return fmt.Errorf("expected status 301, got %d", resp.StatusCode)
-				}
-				loc := resp.Headers["location"].Value
-				if loc != "https://"+testCanonicalSite+"/foo" {
-					return fmt.Errorf("expected location https://"+testCanonicalSite+"/foo, got %s", loc)
-				}
-				return nil
-			},
-		}, {
-			Name: "Webfinger",
-			Request: Request{
-				URI:  "/.well-known/webfinger",
-				Host: testCanonicalSite,
-				Querystring: map[string]string{
-					"resource": url.QueryEscape("acct:" + email),
-				},
+				Host: "non-canonical.example.com",
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 200 {
-					return fmt.Errorf("expected status 200, got %d", resp.StatusCode)
-				}
-				if resp.Headers["content-type"].Value != "application/json" {
-					return fmt.Errorf("expected json content type")
-				}
-				if resp.Body == nil || !strings.Contains(resp.Body.Data, "acct:"+email) {
-					return fmt.Errorf("expected webfinger body to contain email")
-				}
-				return nil
+			Expect: Expect{
+				Status:  301,
+				Headers: map[string]string{"location": "https://" + host + "/foo"},
 			},
 		},
 		{
-			Name: "Go Module Meta (go-get=1)",
+			Name: "Canonical Host Redirect keeps query",
 			Request: Request{
-				URI:  "/oauth2ext",
-				Host: testCanonicalSite,
-				Querystring: map[string]string{
-					"go-get": "1",
-				},
+				URI:         "/foo",
+				Host:        "non-canonical.example.com",
+				Querystring: map[string]string{"a": "1", "b": "x%20y"},
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 200 {
-					return fmt.Errorf("expected status 200, got %d", resp.StatusCode)
-				}
-				if resp.Body == nil || !strings.Contains(resp.Body.Data, "go-import") {
-					return fmt.Errorf("expected go-import meta tag")
-				}
-				return nil
+			Expect: Expect{
+				Status:  301,
+				Headers: map[string]string{"location": "https://" + host + "/foo?a=1&b=x%20y"},
 			},
 		},
 		{
-			Name: "Go Module Redirect (Godoc)",
+			Name: "Canonical Host Redirect (POST)",
 			Request: Request{
-				URI:  "/oauth2ext",
-				Host: testCanonicalSite,
+				Method: "POST",
+				URI:    "/foo",
+				Host:   "non-canonical.example.com",
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 302 {
-					return fmt.Errorf("expected status 302, got %d", resp.StatusCode)
-				}
-				loc := resp.Headers["location"].Value
-				// Verify redirect target matches the configured URL
-				if loc != "https://pkg.go.dev/lds.li/oauth2ext" {
-					return fmt.Errorf("unexpected location: %s", loc)
-				}
-				return nil
+			Expect: Expect{
+				Status:  308,
+				Headers: map[string]string{"location": "https://" + host + "/foo"},
 			},
 		},
 		{
-			Name: "Go Module Subpackage Redirect",
+			Name: "Canonical Host Pass-through",
 			Request: Request{
-				URI:  "/oauth2ext/subpkg",
-				Host: testCanonicalSite,
+				URI:  "/",
+				Host: host,
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 302 {
-					return fmt.Errorf("expected status 302, got %d", resp.StatusCode)
-				}
-				loc := resp.Headers["location"].Value
-				if loc != "https://pkg.go.dev/lds.li/oauth2ext/subpkg" {
-					return fmt.Errorf("unexpected location: %s", loc)
-				}
-				return nil
+			Expect: Expect{},
+		},
+	}
+
+	tests = append(tests, webfingerTests(host, cfg.webfingerAccounts(email))...)
+	tests = append(tests, TestCase{
+		Name: "Webfinger OPTIONS",
+		Request: Request{
+			Method: "OPTIONS",
+			URI:    "/.well-known/webfinger",
+			Host:   host,
+		},
+		Expect: Expect{
+			Status: 204,
+			Headers: map[string]string{
+				"allow":                       "GET, HEAD, OPTIONS",
+				"access-control-allow-origin": "*",
 			},
 		},
-		/*{
-			Name: "Go Module Subdir Meta (go-get=1)",
+	}, TestCase{
+		Name: "Webfinger POST",
+		Request: Request{
+			Method: "POST",
+			URI:    "/.well-known/webfinger",
+			Host:   host,
+		},
+		Expect: Expect{
+			Status:  405,
+			Headers: map[string]string{"allow": "GET, HEAD, OPTIONS"},
+		},
+	}, TestCase{
+		Name: "Webfinger Unknown Account",
+		Request: Request{
+			URI:  "/.well-known/webfinger",
+			Host: host,
+			Querystring: map[string]string{
+				"resource": url.QueryEscape("acct:nobody@example.com"),
+			},
+		},
+		Expect: Expect{Status: 404},
+	})
+
+	tests = append(tests, moduleTests(host, cfg.Modules)...)
+	if compression := cfg.Sync.Compression; compression.Mode == compressionNegotiate {
+		tests = append(tests, compressionTests(host, compression)...)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Hosts)) {
+		alias := cfg.Hosts[name]
+		// A wildcard stands for any name one label deeper
+		aliasHost := strings.Replace(name, "*", "alias-test", 1)
+		if alias.Action != hostServe {
+			tests = append(tests, TestCase{
+				Name: "Alias Host Redirect " + name,
+				Request: Request{
+					URI:  "/foo",
+					Host: aliasHost,
+				},
+				Expect: Expect{
+					Status:  301,
+					Headers: map[string]string{"location": "https://" + host + "/foo"},
+				},
+			})
+			continue
+		}
+		if !alias.ownDomain() {
+			tests = append(tests, TestCase{
+				Name: "Alias Host Pass-through " + name,
+				Request: Request{
+					URI:  "/",
+					Host: aliasHost,
+				},
+				Expect: Expect{URI: "/"},
+			})
+			tests = append(tests, onHost(name, moduleTests(aliasHost, cfg.Modules))...)
+			continue
+		}
+		tests = append(tests, TestCase{
+			Name: "Alias Host Landing Page " + name,
+			Request: Request{
+				URI:  "/",
+				Host: aliasHost,
+			},
+			Expect: Expect{URI: "/" + hostPagesDir + "/" + name + "/index.html"},
+		})
+		tests = append(tests, onHost(name, moduleTests(aliasHost, alias.Modules))...)
+		hostAccounts := webfingerAccounts(alias.Webfinger, email)
+		tests = append(tests, onHost(name, webfingerTests(aliasHost, hostAccounts))...)
+		// The site's modules and accounts belong to the canonical host, not
+		// this one
+		for _, modName := range slices.Sorted(maps.Keys(cfg.Modules)) {
+			if _, ok := alias.Modules[modName]; ok {
+				continue
+			}
+			tests = append(tests, TestCase{
+				Name: "Alias Host " + name + " skips site module " + modName,
+				Request: Request{
+					URI:         "/" + modName,
+					Host:        aliasHost,
+					Querystring: map[string]string{"go-get": "1"},
+				},
+				Expect: Expect{},
+			})
+			break
+		}
+		for _, account := range slices.Sorted(maps.Keys(cfg.webfingerAccounts(email))) {
+			if _, ok := hostAccounts[account]; ok {
+				continue
+			}
+			tests = append(tests, TestCase{
+				Name: "Alias Host " + name + " skips site account " + account,
+				Request: Request{
+					URI:  "/.well-known/webfinger",
+					Host: aliasHost,
+					Querystring: map[string]string{
+						"resource": url.QueryEscape("acct:" + account),
+					},
+				},
+				Expect: Expect{Status: 404},
+			})
+			break
+		}
+	}
+	return tests
+}
+
+// compressionTests check requests are rewritten to the pre-compressed variant
+// of the first encoding in the config's order that the viewer accepts.
+func compressionTests(host string, c CompressionConfig) []TestCase {
+	encs, exts := c.encodings(), c.extensions()
+	if len(encs) == 0 || len(exts) == 0 {
+		return nil
+	}
+	uri := "/compression-test" + exts[0]
+	variant := func(name, uri, acceptEncoding, want string) TestCase {
+		tc := TestCase{
+			Name:    "Pre-compressed " + name,
+			Request: Request{URI: uri, Host: host},
+			Expect:  Expect{URI: want},
+		}
+		if acceptEncoding != "" {
+			tc.Request.Headers = map[string]string{"accept-encoding": acceptEncoding}
+		}
+		return tc
+	}
+
+	var tests []TestCase
+	for _, enc := range encs {
+		tests = append(tests, variant(enc, uri, enc, uri+encodingSuffixes[enc]))
+	}
+	if len(encs) > 1 {
+		first, second := encs[0], encs[1]
+		tests = append(tests,
+			variant("prefers "+first, uri, second+", "+first, uri+encodingSuffixes[first]),
+			variant(first+" refused with q=0", uri, second+", "+first+";q=0", uri+encodingSuffixes[second]),
+		)
+	}
+	tests = append(tests, variant("without Accept-Encoding", uri, "", uri))
+	if slices.Contains(exts, ".html") {
+		tests = append(tests, variant("index", "/", encs[0], "/index.html"+encodingSuffixes[encs[0]]))
+	}
+	if !slices.Contains(exts, ".png") {
+		tests = append(tests, variant("skips other extensions", "/compression-test.png", encs[0], "/compression-test.png"))
+	}
+	return tests
+}
+
+// onHost names tests as run on an alias host, keeping them apart from the
+// canonical host's tests of the same modules or accounts.
+func onHost(name string, tests []TestCase) []TestCase {
+	for i := range tests {
+		tests[i].Name += " on " + name
+	}
+	return tests
+}
+
+// webfingerTests returns a lookup test for each webfinger account served on
+// host.
+func webfingerTests(host string, accounts map[string][]WebfingerLink) []TestCase {
+	var tests []TestCase
+	for _, account := range slices.Sorted(maps.Keys(accounts)) {
+		expect := Expect{
+			Status:  200,
+			Headers: map[string]string{"content-type": "application/json"},
+			JSON:    map[string]any{"subject": "acct:" + account},
+		}
+		for i, link := range accounts[account] {
+			expect.JSON[fmt.Sprintf("links.%d.rel", i)] = link.Rel
+			expect.JSON[fmt.Sprintf("links.%d.href", i)] = link.Href
+		}
+		tests = append(tests, TestCase{
+			Name: "Webfinger " + account,
 			Request: Request{
-				URI:  "/module/submodule",
-				Host: testCanonicalSite,
+				URI:  "/.well-known/webfinger",
+				Host: host,
 				Querystring: map[string]string{
-					"go-get": "1",
+					"resource": url.QueryEscape("acct:" + account),
 				},
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 200 {
-					return fmt.Errorf("expected status 200, got %d", resp.StatusCode)
-				}
-				expectedContent := "lds.li//module/submodule git https://github.com//module/submodule tmpsecrets"
-				if resp.Body == nil || !strings.Contains(resp.Body.Data, expectedContent) {
-					return fmt.Errorf("expected go-import meta tag content '%s'", expectedContent)
-				}
-				return nil
+			Expect: expect,
+		})
+	}
+	return tests
+}
+
+// moduleTests returns go-get and browser redirect tests for each module served
+// on host.
+func moduleTests(host string, modules map[string]ModuleConfig) []TestCase {
+	var tests []TestCase
+	for _, name := range slices.Sorted(maps.Keys(modules)) {
+		mod := modules[name]
+		importContent := mod.Path + " git " + mod.GitURL
+		if mod.SubDir != "" {
+			importContent += " " + mod.SubDir
+		}
+		// Browsers go to redirect_to as is, or to the package on pkg.go.dev
+		// with the query carried over
+		target, subTarget := "https://pkg.go.dev/"+mod.Path, "https://pkg.go.dev/"+mod.Path+"/subpkg"
+		queryTarget := target + "?tab=versions"
+		if mod.RedirectTo != "" {
+			target, subTarget, queryTarget = mod.RedirectTo, mod.RedirectTo, mod.RedirectTo
+		}
+
+		tests = append(tests,
+			TestCase{
+				Name: "Go Module Meta (go-get=1) " + name,
+				Request: Request{
+					URI:         "/" + name,
+					Host:        host,
+					Querystring: map[string]string{"go-get": "1"},
+				},
+				Expect: Expect{
+					Status:       200,
+					BodyContains: []string{`<meta name="go-import" content="` + importContent + `">`},
+				},
+			},
+			TestCase{
+				Name: "Go Module Redirect " + name,
+				Request: Request{
+					URI:  "/" + name,
+					Host: host,
+				},
+				Expect: Expect{
+					Status:  302,
+					Headers: map[string]string{"location": target},
+				},
+			},
+			TestCase{
+				Name: "Go Module Redirect with query " + name,
+				Request: Request{
+					URI:         "/" + name,
+					Host:        host,
+					Querystring: map[string]string{"tab": "versions"},
+				},
+				Expect: Expect{
+					Status:  302,
+					Headers: map[string]string{"location": queryTarget},
+				},
+			},
+			TestCase{
+				Name: "Go Module Subpackage Redirect " + name,
+				Request: Request{
+					URI:  "/" + name + "/subpkg",
+					Host: host,
+				},
+				Expect: Expect{
+					Status:  302,
+					Headers: map[string]string{"location": subTarget},
+				},
 			},
-		},*/
+		)
+	}
+
+	// Methods are handled the same for every module, so check the first
+	if names := slices.Sorted(maps.Keys(modules)); len(names) > 0 {
+		name := names[0]
+		tests = append(tests,
+			TestCase{
+				Name: "Go Module Meta (HEAD) " + name,
+				Request: Request{
+					Method:      "HEAD",
+					URI:         "/" + name,
+					Host:        host,
+					Querystring: map[string]string{"go-get": "1"},
+				},
+				Expect: Expect{
+					Status:  200,
+					Headers: map[string]string{"content-type": "text/html; charset=utf-8"},
+					NoBody:  true,
+				},
+			},
+			TestCase{
+				Name: "Go Module OPTIONS " + name,
+				Request: Request{
+					Method: "OPTIONS",
+					URI:    "/" + name,
+					Host:   host,
+				},
+				Expect: Expect{
+					Status:  204,
+					Headers: map[string]string{"allow": "GET, HEAD, OPTIONS"},
+				},
+			},
+			TestCase{
+				Name: "Go Module POST " + name,
+				Request: Request{
+					Method: "POST",
+					URI:    "/" + name,
+					Host:   host,
+				},
+				Expect: Expect{
+					Status:  405,
+					Headers: map[string]string{"allow": "GET, HEAD, OPTIONS"},
+				},
+			},
+		)
+	}
+	return tests
+}
+
+// HostileSuite returns a copy of cfg with extra modules whose settings try to
+// break out of the go-get page, and tests that they come out escaped. LoadConfig
+// rejects values like these, so the tests only run locally, against a function
+// rendered from the returned config.
+func HostileSuite(cfg *SiteConfig) (*SiteConfig, []TestCase) {
+	hostile := *cfg
+	hostile.Modules = maps.Clone(cfg.Modules)
+	if hostile.Modules == nil {
+		hostile.Modules = make(map[string]ModuleConfig)
+	}
+	hostile.Modules["hostile-redirect"] = ModuleConfig{
+		Path:       cfg.CanonicalHost + "/hostile-redirect",
+		GitURL:     "https://example.com/repo",
+		RedirectTo: `https://example.com/?a=1&b="><script>alert(1)</script>`,
+	}
+	hostile.Modules["hostile-import"] = ModuleConfig{
+		Path:   `example.com/x" onload="alert(1)`,
+		GitURL: "https://example.com/<b>repo</b>",
+		SubDir: "sub'dir",
+	}
+
+	tests := []TestCase{
 		{
-			Name: "Pass-through (Static Asset)",
+			Name: "Hostile redirect_to is escaped",
 			Request: Request{
-				URI:  "/static/style.css",
-				Host: testCanonicalSite,
+				URI:         "/hostile-redirect",
+				Host:        cfg.CanonicalHost,
+				Querystring: map[string]string{"go-get": "1"},
 			},
-			Validator: func(resp Response) error {
-				if resp.StatusCode != 0 {
-					return fmt.Errorf("expected pass-through (no status code), got %d", resp.StatusCode)
-				}
-				return nil
+			Expect: Expect{
+				Status:       200,
+				BodyContains: []string{`url=https://example.com/?a=1&amp;b=&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;"`},
+				BodyExcludes: []string{"<script>"},
+			},
+		},
+		{
+			Name: "Hostile go-import is escaped",
+			Request: Request{
+				URI:         "/hostile-import",
+				Host:        cfg.CanonicalHost,
+				Querystring: map[string]string{"go-get": "1"},
+			},
+			Expect: Expect{
+				Status:       200,
+				BodyContains: []string{`content="example.com/x&#34; onload=&#34;alert(1) git https://example.com/&lt;b&gt;repo&lt;/b&gt; sub&#39;dir"`},
+				BodyExcludes: []string{"<b>", `" onload="`},
 			},
 		},
 	}
+	return &hostile, tests
 }
 
-// Run executes the tests against the specified CloudFront Function
-func RunTests(ctx context.Context, client *cloudfront.Client, name, etag, email string, logger *slog.Logger) error {
-	tests := Suite(email)
-	failed := 0
+// testRunner runs a single test case, see runTest.
+type testRunner func(ctx context.Context, tc TestCase) (testResult, error)
 
-	for _, tc := range tests {
-		logger.Info("Running test", "name", tc.Name)
+// RunTests executes the tests against the DEVELOPMENT stage of the specified
+// CloudFront Function, writing a report if opts asks for one.
+func RunTests(ctx context.Context, client *cloudfront.Client, name, etag string, tests []TestCase, opts *functionTestOptions, logger *slog.Logger) error {
+	results, err := runSuite(ctx, tests, func(ctx context.Context, tc TestCase) (testResult, error) {
+		return runTest(ctx, client, name, etag, types.FunctionStageDevelopment, tc)
+	}, opts, logger)
+	if err != nil {
+		return err
+	}
 
-		eventBytes, err := buildEvent(tc.Request)
-		if err != nil {
-			return fmt.Errorf("failed to build event for %s: %w", tc.Name, err)
+	if opts.CompareLive {
+		if err := compareLive(ctx, client, name, tests, results, logger); err != nil {
+			logger.Warn("Skipping utilization comparison with LIVE", "error", err)
 		}
+	}
+	return reportSuite(name, results, opts, logger)
+}
 
-		out, err := client.TestFunction(ctx, &cloudfront.TestFunctionInput{
-			Name:        &name,
-			IfMatch:     &etag,
-			Stage:       types.FunctionStageDevelopment,
-			EventObject: eventBytes,
-		})
+// runSuite runs every test, applying the utilization budgets.
+func runSuite(ctx context.Context, tests []TestCase, run testRunner, opts *functionTestOptions, logger *slog.Logger) ([]testResult, error) {
+	var results []testResult
+	for _, tc := range tests {
+		logger.Info("Running test", "name", tc.Name)
+		res, err := run(ctx, tc)
 		if err != nil {
-			return fmt.Errorf("AWS API error testing %s: %w", tc.Name, err)
+			return nil, err
 		}
-
-		if out.TestResult.FunctionErrorMessage != nil && *out.TestResult.FunctionErrorMessage != "" {
-			msg := *out.TestResult.FunctionErrorMessage
-			logger.Error("Test failed (runtime error)", "name", tc.Name, "error", msg)
-
-			if len(out.TestResult.FunctionExecutionLogs) > 0 {
-				fmt.Println("---")
-				for _, l := range out.TestResult.FunctionExecutionLogs {
-					fmt.Println(l)
-				}
-				fmt.Println("---")
+		if res.Err == nil {
+			res.Err = opts.checkBudget(tc, res.Utilization)
+		}
+		if res.Err != nil {
+			logger.Error("Test failed", "name", tc.Name, "error", res.Err)
+			for _, l := range res.Logs {
+				logger.Error("Function log", "name", tc.Name, "line", l)
 			}
+		} else {
+			logger.Info("Test passed", "name", tc.Name, "compute_utilization", res.Utilization)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
 
-			if out.TestResult.FunctionOutput != nil {
-				fmt.Printf("Partial Output: %s\n", *out.TestResult.FunctionOutput)
-			}
+// reportSuite summarizes and reports the results, returning an error if any
+// test failed.
+func reportSuite(name string, results []testResult, opts *functionTestOptions, logger *slog.Logger) error {
+	summarizeUtilization(results, logger)
 
-			failed++
-			continue
-		}
+	if err := opts.writeReport(name, results); err != nil {
+		return fmt.Errorf("failed to write test report: %w", err)
+	}
 
-		var wrapper TestOutputWrapper
-		if err := json.Unmarshal([]byte(*out.TestResult.FunctionOutput), &wrapper); err != nil {
-			logger.Error("Test failed (invalid output JSON)", "name", tc.Name, "error", err)
-			fmt.Println("Output:", *out.TestResult.FunctionOutput)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
 			failed++
-			continue
 		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d tests failed", failed)
+	}
+	return nil
+}
 
-		var resp Response
-		if wrapper.Response != nil {
-			resp = *wrapper.Response
-		} else if wrapper.Request != nil {
-			// Pass-through
-			resp = Response{StatusCode: 0}
-		} else {
-			logger.Error("Test failed (unknown output structure)", "name", tc.Name)
-			fmt.Println("Output:", *out.TestResult.FunctionOutput)
-			failed++
-			continue
+// runTest runs a single test case against a stage of the function. Test
+// failures are reported in the result, the error is for failing to run the
+// test at all.
+func runTest(ctx context.Context, client *cloudfront.Client, name, etag string, stage types.FunctionStage, tc TestCase) (testResult, error) {
+	res := testResult{Name: tc.Name, Utilization: "unknown"}
+
+	eventBytes, err := buildEvent(tc.Request)
+	if err != nil {
+		return res, fmt.Errorf("failed to build event for %s: %w", tc.Name, err)
+	}
+
+	out, err := client.TestFunction(ctx, &cloudfront.TestFunctionInput{
+		Name:        &name,
+		IfMatch:     &etag,
+		Stage:       stage,
+		EventObject: eventBytes,
+	})
+	if err != nil {
+		return res, fmt.Errorf("AWS API error testing %s: %w", tc.Name, err)
+	}
+	if out.TestResult.ComputeUtilization != nil {
+		res.Utilization = *out.TestResult.ComputeUtilization
+	}
+	res.Logs = out.TestResult.FunctionExecutionLogs
+
+	if out.TestResult.FunctionErrorMessage != nil && *out.TestResult.FunctionErrorMessage != "" {
+		res.Err = fmt.Errorf("runtime error: %s", *out.TestResult.FunctionErrorMessage)
+		if out.TestResult.FunctionOutput != nil {
+			res.Logs = append(res.Logs, "Partial output: "+*out.TestResult.FunctionOutput)
 		}
+		return res, nil
+	}
 
-		if err := tc.Validator(resp); err != nil {
-			logger.Error("Test failed (assertion)", "name", tc.Name, "error", err)
-			failed++
-		} else {
-			util := "unknown"
-			if out.TestResult.ComputeUtilization != nil {
-				util = *out.TestResult.ComputeUtilization
-			}
-			logger.Info("Test passed", "name", tc.Name, "compute_utilization", util)
+	var wrapper TestOutputWrapper
+	if err := json.Unmarshal([]byte(*out.TestResult.FunctionOutput), &wrapper); err != nil {
+		res.Err = fmt.Errorf("invalid output JSON: %w", err)
+		res.Logs = append(res.Logs, "Output: "+*out.TestResult.FunctionOutput)
+		return res, nil
+	}
+
+	var resp Response
+	if wrapper.Response != nil {
+		resp = *wrapper.Response
+	} else if wrapper.Request != nil {
+		// Pass-through
+		resp = Response{StatusCode: 0}
+		if uri, ok := wrapper.Request["uri"].(string); ok {
+			resp.URI = &uri
 		}
+	} else {
+		res.Err = fmt.Errorf("unknown output structure")
+		res.Logs = append(res.Logs, "Output: "+*out.TestResult.FunctionOutput)
+		return res, nil
 	}
 
-	if failed > 0 {
-		return fmt.Errorf("%d tests failed", failed)
+	if err := tc.Expect.validate(resp); err != nil {
+		res.Err = fmt.Errorf("assertion: %w", err)
 	}
-	return nil
+	return res, nil
 }
 
 func buildEvent(req Request) ([]byte, error) {
@@ -281,6 +619,11 @@ func buildEvent(req Request) ([]byte, error) {
 		qs[k] = HeaderVal{Value: v}
 	}
 
+	cookies := make(map[string]HeaderVal)
+	for k, v := range req.Cookies {
+		cookies[k] = HeaderVal{Value: v}
+	}
+
 	event := map[string]interface{}{
 		"version": "1.0",
 		"context": map[string]string{
@@ -294,7 +637,7 @@ func buildEvent(req Request) ([]byte, error) {
 			"uri":         req.URI,
 			"headers":     hdrs,
 			"querystring": qs,
-			"cookies":     map[string]interface{}{}, // Required by CloudFront
+			"cookies":     cookies, // Required by CloudFront, even if empty
 		},
 	}
 
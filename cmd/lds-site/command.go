@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// runFunc runs a command once its flags have been parsed.
+type runFunc func(ctx context.Context, logger *slog.Logger) error
+
+// command is a node in the CLI tree. Leaf commands declare their flags in
+// setup, which returns the function to run with them. Group commands only
+// dispatch to their subcommands.
+type command struct {
+	name        string
+	summary     string
+	setup       func(fs *flag.FlagSet) runFunc
+	subcommands []*command
+}
+
+// errUsage is returned when a command line can't be dispatched. Usage has
+// already been printed when it is returned.
+var errUsage = errors.New("invalid usage")
+
+// execute dispatches args to the command they name. path is the full name of
+// c as typed, e.g. "lds-site cf".
+func (c *command) execute(ctx context.Context, logger *slog.Logger, path string, args []string) error {
+	if c.setup == nil {
+		if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+			c.printUsage(os.Stderr, path)
+			if len(args) == 0 {
+				return errUsage
+			}
+			return nil
+		}
+		sub := c.subcommand(args[0])
+		if sub == nil {
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+			c.printUsage(os.Stderr, path)
+			return errUsage
+		}
+		return sub.execute(ctx, logger, path+" "+sub.name, args[1:])
+	}
+
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	run := c.setup(fs)
+	fs.Usage = func() { c.printUsage(fs.Output(), path) }
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return errUsage
+	}
+	if err := applyFlagDefaults(fs); err != nil {
+		return err
+	}
+
+	return run(ctx, logger)
+}
+
+func (c *command) subcommand(name string) *command {
+	for _, sub := range c.subcommands {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (c *command) printUsage(w io.Writer, path string) {
+	if c.setup == nil {
+		fmt.Fprintf(w, "Usage: %s <command> [args]\n", path)
+		if c.summary != "" {
+			fmt.Fprintf(w, "\n%s\n", c.summary)
+		}
+		fmt.Fprintf(w, "\nCommands:\n")
+		for _, sub := range c.subcommands {
+			fmt.Fprintf(w, "  %-12s%s\n", sub.name, sub.summary)
+		}
+		fmt.Fprintf(w, "\nRun '%s <command> -help' for details.\n", path)
+		return
+	}
+
+	fmt.Fprintf(w, "Usage: %s [flags]\n\n%s\n\nFlags:\n", path, c.summary)
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	c.setup(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		name, usage := flag.UnquoteUsage(f)
+		fmt.Fprintf(w, "  -%s", f.Name)
+		if name != "" {
+			fmt.Fprintf(w, " %s", name)
+		}
+		fmt.Fprintf(w, "\n    \t%s", usage)
+		if f.DefValue != "" && f.DefValue != "false" {
+			fmt.Fprintf(w, " (default %q)", f.DefValue)
+		}
+		fmt.Fprintf(w, " [$%s]\n", flagEnvName(f.Name))
+	})
+}
+
+// complete returns completion candidates for the word being typed, given the
+// words before it. Subcommands complete at group level, flags at leaf level.
+func (c *command) complete(words []string) []string {
+	if c.setup == nil {
+		if len(words) > 0 {
+			if sub := c.subcommand(words[0]); sub != nil {
+				return sub.complete(words[1:])
+			}
+			return nil
+		}
+		var names []string
+		for _, sub := range c.subcommands {
+			names = append(names, sub.name)
+		}
+		return names
+	}
+
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	c.setup(fs)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// flagNames adds the names of the flags of c and every command under it to
+// names.
+func (c *command) flagNames(names map[string]bool) {
+	if c.setup != nil {
+		fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+		c.setup(fs)
+		fs.VisitAll(func(f *flag.Flag) {
+			names[f.Name] = true
+		})
+	}
+	for _, sub := range c.subcommands {
+		sub.flagNames(names)
+	}
+}
+
+// applyFlagDefaults fills in flags not set on the command line, first from
+// environment variables (see flagEnvName), then from the environment selected
+// by -env and finally from the defaults section of the site config named by
+// the -config flag, if the command has one.
+func applyFlagDefaults(fs *flag.FlagSet) error {
+	if err := parseEnvFlags(fs); err != nil {
+		return err
+	}
+
+	configFlag := fs.Lookup("config")
+	if configFlag == nil {
+		return nil
+	}
+	cfg, err := loadConfigDefaults(configFlag.Value.String())
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	apply := func(name, val string) error {
+		f := fs.Lookup(name)
+		if f == nil || set[name] {
+			return nil
+		}
+		if _, ok := os.LookupEnv(flagEnvName(name)); ok {
+			return nil
+		}
+		if err := f.Value.Set(val); err != nil {
+			return fmt.Errorf("invalid value for %s in config defaults: %w", name, err)
+		}
+		return nil
+	}
+
+	// The environment can itself come from the defaults, so pick it first.
+	if env, ok := cfg.Defaults["env"]; ok {
+		if err := apply("env", env); err != nil {
+			return err
+		}
+	}
+	values := maps.Clone(cfg.Defaults)
+	if values == nil {
+		values = make(map[string]string)
+	}
+	if envFlag := fs.Lookup("env"); envFlag != nil && envFlag.Value.String() != "" {
+		env, ok := cfg.Environments[envFlag.Value.String()]
+		if !ok {
+			return fmt.Errorf("unknown environment %q", envFlag.Value.String())
+		}
+		maps.Copy(values, env.flagDefaults())
+	}
+	// The defaults are shared by every command, so only a name no command
+	// has a flag for is a mistake
+	known := make(map[string]bool)
+	rootCommand.flagNames(known)
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if !known[name] {
+			return fmt.Errorf("unknown flag %q in config defaults", name)
+		}
+	}
+	for name, val := range values {
+		if err := apply(name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completionScripts are printed by the completion command. They call back
+// into "lds-site __complete <words...>" for candidates.
+var completionScripts = map[string]string{
+	"bash": `_lds_site() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    COMPREPLY=( $(compgen -W "$(${COMP_WORDS[0]} __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}")" -- "$cur") )
+}
+complete -F _lds_site lds-site
+`,
+	"zsh": `autoload -U +X bashcompinit && bashcompinit
+_lds_site() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    COMPREPLY=( $(compgen -W "$(${COMP_WORDS[0]} __complete "${COMP_WORDS[@]:1:COMP_CWORD-1}")" -- "$cur") )
+}
+complete -F _lds_site lds-site
+`,
+}
+
+// completionCommand prints a completion script for the user's shell.
+var completionCommand = &command{
+	name:    "completion",
+	summary: "Print a shell completion script",
+	setup: func(fs *flag.FlagSet) runFunc {
+		shell := fs.String("shell", "bash", "Shell to generate completion for (bash or zsh)")
+		return func(ctx context.Context, logger *slog.Logger) error {
+			script, ok := completionScripts[*shell]
+			if !ok {
+				return fmt.Errorf("unsupported shell %q", *shell)
+			}
+			fmt.Print(script)
+			return nil
+		}
+	},
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// compressionSingle stores only a compressed copy of each asset, served
+	// with its Content-Encoding to every client.
+	compressionSingle = "single"
+	// compressionNegotiate stores the original alongside one variant per
+	// encoding, and the edge function picks one based on Accept-Encoding.
+	compressionNegotiate = "negotiate"
+)
+
+// encodingSuffixes maps a Content-Encoding to the key suffix used for its
+// variant in negotiate mode.
+var encodingSuffixes = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// defaultCompressedExtensions are compressed when no extensions are configured.
+var defaultCompressedExtensions = []string{
+	".html", ".css", ".js", ".mjs", ".json", ".map", ".webmanifest",
+	".svg", ".xml", ".atom", ".rss", ".txt", ".md", ".wasm",
+}
+
+func (c CompressionConfig) encodings() []string {
+	if len(c.Encodings) > 0 {
+		return c.Encodings
+	}
+	if c.Mode == compressionSingle {
+		return []string{"gzip"}
+	}
+	return []string{"br", "gzip"}
+}
+
+func (c CompressionConfig) extensions() []string {
+	if len(c.Extensions) > 0 {
+		return c.Extensions
+	}
+	return defaultCompressedExtensions
+}
+
+// appliesTo reports whether the object at key should be compressed.
+func (c CompressionConfig) appliesTo(key string) bool {
+	if c.Mode == "" {
+		return false
+	}
+	return slices.Contains(c.extensions(), strings.ToLower(path.Ext(key)))
+}
+
+func (c CompressionConfig) validate() error {
+	switch c.Mode {
+	case "", compressionSingle, compressionNegotiate:
+	default:
+		return fmt.Errorf("unknown compression mode %q", c.Mode)
+	}
+	for _, enc := range c.Encodings {
+		if _, ok := encodingSuffixes[enc]; !ok {
+			return fmt.Errorf("unknown compression encoding %q", enc)
+		}
+	}
+	if c.Mode == compressionSingle && len(c.Encodings) > 1 {
+		return fmt.Errorf("single compression mode takes one encoding, got %d", len(c.Encodings))
+	}
+	for _, ext := range c.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			return fmt.Errorf("compression extension %q must start with a dot", ext)
+		}
+	}
+	return nil
+}
+
+// compress encodes data with the given Content-Encoding at maximum compression.
+func compress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
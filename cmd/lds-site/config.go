@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/lstoll/lds.li/email"
 	"gopkg.in/yaml.v3"
 )
 
@@ -10,6 +18,160 @@ type SiteConfig struct {
 	CanonicalHost string                     `yaml:"canonical_host"`
 	Modules       map[string]ModuleConfig    `yaml:"modules"`
 	Webfinger     map[string][]WebfingerLink `yaml:"webfinger"`
+	Sync          SyncConfig                 `yaml:"sync"`
+	Email         EmailConfig                `yaml:"email"`
+	Secrets       map[string]SecretConfig    `yaml:"secrets"`
+	// Defaults for command flags, keyed by flag name. They apply when a flag
+	// is set neither on the command line nor in the environment.
+	Defaults map[string]string `yaml:"defaults"`
+	// Environments are named deploy targets, selected with -env
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+	// Hosts are other names the distribution answers on. Any host that is
+	// neither the canonical host nor listed is redirected to the canonical host.
+	Hosts map[string]HostConfig `yaml:"hosts"`
+}
+
+const (
+	hostRedirect = "redirect"
+	hostServe    = "serve"
+)
+
+// HostConfig is how requests for an alias host are handled. Keys are host
+// names, where a leading "*." matches one more label, e.g. "*.cloudfront.net".
+// A served host with its own modules or webfinger links is a separate vanity
+// domain, with its own landing page.
+type HostConfig struct {
+	Action    string                     `yaml:"action"`    // "redirect" (default) to the canonical host, or "serve"
+	Title     string                     `yaml:"title"`     // Optional, landing page title, defaults to the host name
+	Modules   map[string]ModuleConfig    `yaml:"modules"`   // Optional, served on this host instead of the site modules
+	Webfinger map[string][]WebfingerLink `yaml:"webfinger"` // Optional, served on this host instead of the site links
+}
+
+// ownDomain reports whether the host serves its own modules and webfinger
+// links rather than the site's.
+func (h HostConfig) ownDomain() bool {
+	return len(h.Modules) > 0 || len(h.Webfinger) > 0
+}
+
+// hostNamePattern is what a hosts key may be: a lower case DNS name, with an
+// optional wildcard first label.
+var hostNamePattern = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+func (h HostConfig) validate(name string) error {
+	if !hostNamePattern.MatchString(name) {
+		return fmt.Errorf("host %q is not a lower case DNS name", name)
+	}
+	switch h.Action {
+	case "", hostRedirect, hostServe:
+	default:
+		return fmt.Errorf("host %s: unknown action %q, want %s or %s", name, h.Action, hostRedirect, hostServe)
+	}
+	if h.ownDomain() && h.Action != hostServe {
+		return fmt.Errorf("host %s: modules and webfinger are only served with action %s", name, hostServe)
+	}
+	for key, mod := range h.Modules {
+		if err := mod.validate(key); err != nil {
+			return fmt.Errorf("host %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// EnvironmentConfig is a deploy target such as staging or prod. Its settings
+// act as defaults for the matching command flags, taking precedence over the
+// top level defaults.
+type EnvironmentConfig struct {
+	CanonicalHost  string     `yaml:"canonical_host"`  // Optional, overrides the site canonical host
+	Bucket         string     `yaml:"bucket"`          // e.g., "lds-li-staging"
+	DistributionID string     `yaml:"distribution_id"` // e.g., "E2EXAMPLE"
+	FunctionARN    string     `yaml:"function_arn"`    // Name or ARN of the CloudFront function
+	KVSARN         string     `yaml:"kvs_arn"`         // Optional, KeyValueStore for the registries
+	AWSRoleARN     string     `yaml:"aws_role_arn"`    // Optional, the default credential chain is used if empty
+	AWSRegion      string     `yaml:"aws_region"`      // Optional, e.g., "us-east-1"
+	OIDC           OIDCConfig `yaml:"oidc"`            // Optional, for assuming AWSRoleARN
+}
+
+// OIDCConfig is the identity provider used to assume an AWS role
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`        // e.g., "https://id.lds.li"
+	ClientID     string `yaml:"client_id"`     // e.g., "sts.amazonaws.com"
+	ClientSecret string `yaml:"client_secret"` // e.g., "public"
+}
+
+// flagDefaults returns the environment's settings keyed by the flag they
+// default.
+func (e EnvironmentConfig) flagDefaults() map[string]string {
+	values := make(map[string]string)
+	for name, val := range map[string]string{
+		"bucket":             e.Bucket,
+		"distribution-id":    e.DistributionID,
+		"function-arn":       e.FunctionARN,
+		"kvs-arn":            e.KVSARN,
+		"aws-role-arn":       e.AWSRoleARN,
+		"aws-region":         e.AWSRegion,
+		"oidc-issuer":        e.OIDC.Issuer,
+		"oidc-client-id":     e.OIDC.ClientID,
+		"oidc-client-secret": e.OIDC.ClientSecret,
+	} {
+		if val != "" {
+			values[name] = val
+		}
+	}
+	return values
+}
+
+// useEnvironment applies the named environment's overrides to the config. An
+// empty name leaves it unchanged.
+func (c *SiteConfig) useEnvironment(name string) error {
+	if name == "" {
+		return nil
+	}
+	env, ok := c.Environments[name]
+	if !ok {
+		return fmt.Errorf("unknown environment %q", name)
+	}
+	if env.CanonicalHost != "" {
+		c.CanonicalHost = env.CanonicalHost
+	}
+	return nil
+}
+
+// SecretConfig is a contact detail protected on the site like the email
+// address. Its value comes from the environment or, if public enough to commit,
+// the config itself.
+type SecretConfig struct {
+	Env   string `yaml:"env"`   // e.g., "LDS_SITE_PHONE"
+	Value string `yaml:"value"` // Optional, used if Env is unset
+}
+
+func (sc SecretConfig) validate(name string) error {
+	// The -email address is always revealed as "email", and webfinger uses it
+	if name == "email" {
+		return fmt.Errorf("secret name email is reserved for the email address")
+	}
+	if sc.Env == "" && sc.Value == "" {
+		return fmt.Errorf("secret %s: env or value is required", name)
+	}
+	return nil
+}
+
+// EmailConfig tunes the proof of work protecting the email address and other
+// secrets on the site
+type EmailConfig struct {
+	DifficultyBits int    `yaml:"difficulty_bits"` // Optional, e.g., 16
+	Work           string `yaml:"work"`            // Optional, "sha256" or "pbkdf2-sha256"
+	Iterations     int    `yaml:"iterations"`      // Optional, PBKDF2 iterations per attempt
+}
+
+// options returns the email obfuscation options. The seed is a build secret,
+// so it is passed in rather than read from the config file.
+func (c EmailConfig) options(seed string) email.Options {
+	return email.Options{
+		DifficultyBits: c.DifficultyBits,
+		Work:           c.Work,
+		Iterations:     c.Iterations,
+		Seed:           []byte(seed),
+	}
 }
 
 // ModuleConfig represents metadata for a Go module
@@ -20,6 +182,120 @@ type ModuleConfig struct {
 	SubDir     string `yaml:"subdir" json:"SubDir"`          // Optional, e.g. "director" for subdiretory in the repo
 }
 
+// moduleKeyPattern is what a module key, used as its URL path, may contain
+var moduleKeyPattern = regexp.MustCompile(`^[A-Za-z0-9._~-]+(/[A-Za-z0-9._~-]+)*$`)
+
+// validate rejects module settings that can't be served safely. Values end up
+// in HTML attributes and redirects, so quotes, markup, whitespace and control
+// characters are never allowed.
+func (m ModuleConfig) validate(key string) error {
+	if !moduleKeyPattern.MatchString(key) {
+		return fmt.Errorf("module key %q must be slash-separated path segments of letters, digits and ._~-", key)
+	}
+	for name, val := range map[string]string{
+		"path":        m.Path,
+		"git_url":     m.GitURL,
+		"redirect_to": m.RedirectTo,
+		"subdir":      m.SubDir,
+	} {
+		if i := strings.IndexFunc(val, unsafeModuleRune); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(val[i:])
+			return fmt.Errorf("module %s: %s contains unsafe character %q", key, name, r)
+		}
+	}
+	if m.Path == "" {
+		return fmt.Errorf("module %s: path is required", key)
+	}
+	if err := checkHTTPURL(m.GitURL); err != nil {
+		return fmt.Errorf("module %s: git_url: %w", key, err)
+	}
+	if m.RedirectTo != "" {
+		if err := checkHTTPURL(m.RedirectTo); err != nil {
+			return fmt.Errorf("module %s: redirect_to: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func unsafeModuleRune(r rune) bool {
+	return strings.ContainsRune("\"'<>`\\", r) || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// checkHTTPURL returns an error unless u is an absolute http or https URL.
+func checkHTTPURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute http(s) URL", u)
+	}
+	return nil
+}
+
+// SyncConfig controls how the generated site is uploaded to S3
+type SyncConfig struct {
+	Rules       []SyncRule        `yaml:"rules"`
+	Compression CompressionConfig `yaml:"compression"`
+}
+
+// CompressionConfig controls pre-compression of text assets during sync
+type CompressionConfig struct {
+	Mode       string   `yaml:"mode"`       // "single" or "negotiate", empty disables compression
+	Encodings  []string `yaml:"encodings"`  // Optional, "br" and/or "gzip" in order of preference
+	Extensions []string `yaml:"extensions"` // Optional, e.g., [".html", ".css"]
+}
+
+// SyncRule sets object metadata for keys matching a glob. All matching rules
+// apply in order, later ones overriding the fields they set.
+type SyncRule struct {
+	Match              string            `yaml:"match"`               // e.g., "static/**/*.css"
+	ContentType        string            `yaml:"content_type"`        // Optional, overrides the resolved type
+	CacheControl       string            `yaml:"cache_control"`       // e.g., "public, max-age=300"
+	ContentDisposition string            `yaml:"content_disposition"` // Optional, e.g., "attachment"
+	StorageClass       string            `yaml:"storage_class"`       // Optional, e.g., "STANDARD_IA"
+	Metadata           map[string]string `yaml:"metadata"`            // Optional x-amz-meta-* values
+}
+
+// secretValues resolves the values of every protected contact detail, keyed by
+// name. The email address is always present, as "email".
+func (c *SiteConfig) secretValues(emailAddr string) (map[string]string, error) {
+	values := map[string]string{"email": emailAddr}
+	for name, sc := range c.Secrets {
+		value := sc.Value
+		if sc.Env != "" {
+			v, ok := os.LookupEnv(sc.Env)
+			if !ok {
+				return nil, fmt.Errorf("secret %s: environment variable %s is not set", name, sc.Env)
+			}
+			value = v
+		}
+		if value == "" {
+			return nil, fmt.Errorf("secret %s has no value", name)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// webfingerAccounts returns the webfinger links keyed by account, with the
+// %%EMAIL%% placeholder replaced by the email address.
+func (c *SiteConfig) webfingerAccounts(emailAddr string) map[string][]WebfingerLink {
+	return webfingerAccounts(c.Webfinger, emailAddr)
+}
+
+func webfingerAccounts(links map[string][]WebfingerLink, emailAddr string) map[string][]WebfingerLink {
+	accounts := make(map[string][]WebfingerLink)
+	for k, v := range links {
+		if k == "%%EMAIL%%" {
+			accounts[emailAddr] = v
+		} else {
+			accounts[k] = v
+		}
+	}
+	return accounts
+}
+
 // WebfingerLink represents a link in a webfinger response
 type WebfingerLink struct {
 	Rel  string `yaml:"rel" json:"rel"`
@@ -27,15 +303,43 @@ type WebfingerLink struct {
 }
 
 func LoadConfig(path string) (*SiteConfig, error) {
-	f, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	return parseConfig(data)
+}
 
+// parseConfig decodes and validates a site config.
+func parseConfig(data []byte) (*SiteConfig, error) {
 	var cfg SiteConfig
-	if err := yaml.NewDecoder(f).Decode(&cfg); err != nil {
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&cfg); err != nil {
 		return nil, err
 	}
+	for key, mod := range cfg.Modules {
+		if err := mod.validate(key); err != nil {
+			return nil, fmt.Errorf("invalid modules config: %w", err)
+		}
+	}
+	for name, host := range cfg.Hosts {
+		if err := host.validate(name); err != nil {
+			return nil, fmt.Errorf("invalid hosts config: %w", err)
+		}
+	}
+	for name, sc := range cfg.Secrets {
+		if err := sc.validate(name); err != nil {
+			return nil, fmt.Errorf("invalid secrets config: %w", err)
+		}
+	}
+	// The seed is a build secret and doesn't affect validity
+	if err := cfg.Email.options("").Validate(); err != nil {
+		return nil, fmt.Errorf("invalid email config: %w", err)
+	}
+	if err := cfg.Sync.validate(); err != nil {
+		return nil, fmt.Errorf("invalid sync config: %w", err)
+	}
+	if err := cfg.Sync.Compression.validate(); err != nil {
+		return nil, fmt.Errorf("invalid sync config: %w", err)
+	}
 	return &cfg, nil
 }
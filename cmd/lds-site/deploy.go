@@ -3,70 +3,53 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log/slog"
-	"os"
 )
 
-func runDeployAll(ctx context.Context, logger *slog.Logger, args []string) {
-	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
-	
-	// Sync Flags
-	bucket := fs.String("bucket", "", "S3 bucket name")
-	dir := fs.String("dir", "build", "Directory to sync")
-	generate := fs.Bool("generate", true, "Generate site before syncing")
-	distributionID := fs.String("distribution-id", "", "CloudFront distribution ID to invalidate")
-	
-	// CF Deploy Flags
-	functionARN := fs.String("function-arn", "", "CloudFront Function Name or ARN (must exist)")
-	stage := fs.String("stage", "LIVE", "Stage (DEVELOPMENT or LIVE)")
-	configFile := fs.String("config", "site.yaml", "Site configuration file")
-	runTests := fs.Bool("test", true, "Run tests after updating development stage")
-
-	// Shared Flags
-	emailAddr := fs.String("email", os.Getenv("EMAIL_ADDRESS"), "Email address")
-
-	awsAuth := addAWSAuthFlags(fs)
-
-	fs.Parse(args)
-
-	if err := parseEnvFlags(fs); err != nil {
-		logger.Error("Failed to parse env flags", "error", err)
-		os.Exit(1)
-	}
+var deployCommand = &command{
+	name:    "deploy",
+	summary: "Shortcut to sync site and deploy function",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		syncOpts := addSyncFlags(fs)
+		cfOpts := addCFDeployFlags(fs)
+		awsAuth := addAWSAuthFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			return runDeployAll(ctx, logger, site, syncOpts, cfOpts, awsAuth)
+		}
+	},
+}
 
+func runDeployAll(ctx context.Context, logger *slog.Logger, site *siteOptions, syncOpts *syncOptions, cfOpts *cfDeployOptions, awsAuth *AWSAuthConfig) error {
 	// Validate required flags for both
-	if *bucket == "" {
-		logger.Error("Bucket name is required")
-		os.Exit(1)
+	if syncOpts.Bucket == "" {
+		return fmt.Errorf("bucket name is required")
 	}
-	if *functionARN == "" {
-		logger.Error("Function name or ARN is required")
-		os.Exit(1)
+	if cfOpts.FunctionARN == "" {
+		return fmt.Errorf("function name or ARN is required")
 	}
-	if *emailAddr == "" {
-		logger.Error("Email address is required")
-		os.Exit(1)
+	if site.Email == "" {
+		return fmt.Errorf("email address is required")
 	}
 
 	cfg, err := awsAuth.Load(ctx)
 	if err != nil {
-		logger.Error("Failed to load AWS config", "error", err)
-		os.Exit(1)
+		return fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
 	// Run Sync
 	logger.Info("Starting Site Sync...")
-	if err := doSync(ctx, logger, cfg, *bucket, *dir, *generate, *emailAddr, *distributionID); err != nil {
-		logger.Error("Sync failed", "error", err)
-		os.Exit(1)
+	if err := doSync(ctx, logger, cfg, site, syncOpts); err != nil {
+		return fmt.Errorf("sync failed: %w", err)
 	}
 
 	// Run CF Deploy
 	logger.Info("Starting CloudFront Deploy...")
-	if err := doCFDeploy(ctx, logger, cfg, *functionARN, *stage, *emailAddr, *configFile, *runTests); err != nil {
-		logger.Error("CloudFront Deploy failed", "error", err)
-		os.Exit(1)
+	if err := doCFDeploy(ctx, logger, cfg, site, cfOpts); err != nil {
+		return fmt.Errorf("CloudFront deploy failed: %w", err)
 	}
 
 	logger.Info("Full deployment completed successfully.")
+	return nil
 }
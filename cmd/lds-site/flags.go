@@ -1,15 +1,175 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"os"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
+// siteOptions are shared by commands that read the site config.
+type siteOptions struct {
+	ConfigFile string
+	Env        string
+	Email      string
+}
+
+func addSiteFlags(fs *flag.FlagSet) *siteOptions {
+	o := &siteOptions{}
+	fs.StringVar(&o.ConfigFile, "config", "site.yaml", "Site configuration file")
+	fs.StringVar(&o.Env, "env", "", "Environment from the site config to use (e.g. staging or prod)")
+	fs.StringVar(&o.Email, "email", os.Getenv("EMAIL_ADDRESS"), "Email address")
+	return o
+}
+
+// loadConfig loads the site config with the selected environment applied.
+func (o *siteOptions) loadConfig() (*SiteConfig, error) {
+	cfg, err := LoadConfig(o.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load site config: %w", err)
+	}
+	if err := cfg.useEnvironment(o.Env); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// buildOptions control site generation.
+type buildOptions struct {
+	EmailSeed string
+	Minify    bool
+}
+
+func addBuildFlags(fs *flag.FlagSet, minify bool) *buildOptions {
+	o := &buildOptions{}
+	fs.StringVar(&o.EmailSeed, "email-seed", "", "Secret to derive email obfuscation from, for reproducible builds (random if empty)")
+	fs.BoolVar(&o.Minify, "minify", minify, "Minify HTML, CSS, JS, SVG, XML and JSON output")
+	return o
+}
+
+// syncOptions control uploading the site to S3.
+type syncOptions struct {
+	Bucket         string
+	Dir            string
+	Generate       bool
+	DistributionID string
+	DryRun         bool
+	PruneAssets    bool
+	Build          *buildOptions
+}
+
+func addSyncFlags(fs *flag.FlagSet) *syncOptions {
+	o := &syncOptions{}
+	fs.StringVar(&o.Bucket, "bucket", "", "S3 bucket name")
+	fs.StringVar(&o.Dir, "dir", "build", "Directory to sync")
+	fs.BoolVar(&o.Generate, "generate", true, "Generate site before syncing")
+	fs.StringVar(&o.DistributionID, "distribution-id", "", "CloudFront distribution ID to invalidate")
+	fs.BoolVar(&o.PruneAssets, "prune-assets", false, "Also delete fingerprinted assets missing from the build, which pages cached before the sync may still load")
+	o.Build = addBuildFlags(fs, true)
+	return o
+}
+
+// cfDeployOptions control deploying the CloudFront function.
+type cfDeployOptions struct {
+	FunctionARN    string
+	Stage          string
+	RunTests       bool
+	MinifyFunction bool
+	KVS            *kvsOptions
+	Tests          *functionTestOptions
+	// Sync the KeyValueStore before the DEVELOPMENT tests rather than just
+	// before publishing. LIVE reads the same store, so this changes its
+	// routing even if the tests fail.
+	SyncKVSFirst bool
+}
+
+func addCFDeployFlags(fs *flag.FlagSet) *cfDeployOptions {
+	o := &cfDeployOptions{}
+	fs.StringVar(&o.FunctionARN, "function-arn", "", "CloudFront Function Name or ARN (must exist)")
+	fs.StringVar(&o.Stage, "stage", "LIVE", "Stage (DEVELOPMENT or LIVE)")
+	fs.BoolVar(&o.RunTests, "test", true, "Run tests after updating development stage")
+	fs.BoolVar(&o.MinifyFunction, "minify-function", true, "Minify the function code to fit more config under the CloudFront size limit")
+	o.KVS = addKVSFlags(fs)
+	fs.BoolVar(&o.SyncKVSFirst, "sync-kvs-first", false, "Sync the KeyValueStore before running tests, so they see registry changes (LIVE reads the same store)")
+	o.Tests = addFunctionTestFlags(fs)
+	return o
+}
+
+// kvsOptions select the KeyValueStore holding the registries.
+type kvsOptions struct {
+	ARN string
+}
+
+func addKVSFlags(fs *flag.FlagSet) *kvsOptions {
+	o := &kvsOptions{}
+	fs.StringVar(&o.ARN, "kvs-arn", "", "CloudFront KeyValueStore ARN to hold the module and webfinger registries (inlined in the function if empty)")
+	return o
+}
+
+// functionTestOptions control the CloudFront function tests.
+type functionTestOptions struct {
+	File           string
+	Report         string
+	ReportFile     string
+	MaxUtilization int
+	CompareLive    bool
+}
+
+func addFunctionTestFlags(fs *flag.FlagSet) *functionTestOptions {
+	o := &functionTestOptions{}
+	fs.StringVar(&o.File, "tests", "", "YAML or JSON file of test cases to run in addition to those derived from the site config")
+	fs.StringVar(&o.Report, "report", "", "Write a test report in this format (junit or tap)")
+	fs.StringVar(&o.ReportFile, "report-file", "", "File to write the test report to (stdout if empty)")
+	fs.IntVar(&o.MaxUtilization, "max-utilization", 80, "Fail tests whose compute utilization exceeds this percentage, unless the test sets its own budget (0 disables)")
+	fs.BoolVar(&o.CompareLive, "compare-live", true, "Also run the tests against the LIVE stage and compare compute utilization")
+	return o
+}
+
+// repoSourceOptions select where modules are looked for: local clones or a
+// GitHub user or organization.
+type repoSourceOptions struct {
+	Dir         string
+	GitHub      string
+	GitHubToken string
+	GitHubAPI   string
+}
+
+func addRepoSourceFlags(fs *flag.FlagSet) *repoSourceOptions {
+	o := &repoSourceOptions{}
+	fs.StringVar(&o.Dir, "dir", "", "Directory of local clones, or a single clone, to look for modules in")
+	fs.StringVar(&o.GitHub, "github", "", "GitHub user or organization whose repositories to look for modules in")
+	fs.StringVar(&o.GitHubToken, "github-token", "", "GitHub API token (optional, for private repositories and higher rate limits)")
+	fs.StringVar(&o.GitHubAPI, "github-api", "https://api.github.com", "GitHub API base URL")
+	return o
+}
+
+// source returns the selected repository source. keepInactive includes forks
+// and archived repositories in a GitHub listing.
+func (o *repoSourceOptions) source(keepInactive bool) (repoSource, error) {
+	switch {
+	case o.Dir != "" && o.GitHub != "":
+		return nil, fmt.Errorf("only one of -dir and -github can be set")
+	case o.Dir != "":
+		return &localRepos{Dir: o.Dir}, nil
+	case o.GitHub != "":
+		return &githubRepos{Owner: o.GitHub, Token: o.GitHubToken, API: o.GitHubAPI, KeepInactive: keepInactive}, nil
+	default:
+		return nil, fmt.Errorf("one of -dir or -github is required")
+	}
+}
+
+// flagEnvName returns the environment variable that can set a flag: "LDS_SITE_"
+// + the flag name upper-cased, with dashes replaced by underscores.
+func flagEnvName(name string) string {
+	return "LDS_SITE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
 // parseEnvFlags checks environment variables for any flags that haven't been set
-// on the command line. The environment variable name is "LDS_SITE_" + the flag name
-// upper-cased, with dashes replaced by underscores.
+// on the command line. The environment variable name is given by flagEnvName.
 func parseEnvFlags(fs *flag.FlagSet) error {
 	seen := make(map[string]bool)
 	fs.Visit(func(f *flag.Flag) {
@@ -25,7 +185,7 @@ func parseEnvFlags(fs *flag.FlagSet) error {
 			return
 		}
 
-		envName := "LDS_SITE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		envName := flagEnvName(f.Name)
 		if val, ok := os.LookupEnv(envName); ok {
 			if setErr := f.Value.Set(val); setErr != nil {
 				err = fmt.Errorf("invalid value for environment variable %s: %w", envName, setErr)
@@ -34,3 +194,27 @@ func parseEnvFlags(fs *flag.FlagSet) error {
 	})
 	return err
 }
+
+// configDefaults are the parts of a site config that supply flag values.
+type configDefaults struct {
+	Defaults     map[string]string            `yaml:"defaults"`
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+}
+
+// loadConfigDefaults reads the flag defaults and environments of a site config.
+// It only decodes those sections, so a missing or otherwise invalid config is
+// reported by the command itself when it loads the config.
+func loadConfigDefaults(path string) (*configDefaults, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &configDefaults{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cfg configDefaults
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &cfg, nil
+}
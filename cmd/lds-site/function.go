@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+	"github.com/dop251/goja"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// maxFunctionSize is the largest function code CloudFront accepts.
+const maxFunctionSize = 10 * 1024
+
+const (
+	varsStartMarker = "/* START VARS */"
+	varsEndMarker   = "/* END VARS */"
+)
+
+// renderedFunction is CloudFront function code along with where its bytes go.
+type renderedFunction struct {
+	Code     []byte
+	Sections []functionSection
+}
+
+// functionSection is a part of the rendered function: the template code, or
+// one of the injected config variables.
+type functionSection struct {
+	Name string
+	Size int
+}
+
+// functionRuntime is the CloudFront runtime the template is written for. It is
+// the first with KeyValueStore support.
+const functionRuntime = types.FunctionRuntimeCloudfrontJs20
+
+// renderOptions control how the function is rendered.
+type renderOptions struct {
+	// Minify the template code. The injected config is compact already.
+	Minify bool
+	// KVSID is the KeyValueStore holding the registries. If empty they are
+	// inlined in the code.
+	KVSID string
+}
+
+// renderFunction renders the CloudFront function for the site, injecting the
+// precomputed config into the template's vars block.
+func renderFunction(siteCfg *SiteConfig, emailAddr string, opts renderOptions) (*renderedFunction, error) {
+	routes := siteModuleRoutes(siteCfg)
+	accounts := siteWebfingerAccounts(siteCfg, emailAddr)
+	if opts.KVSID != "" {
+		// Looked up at request time instead
+		routes, accounts = map[string][]moduleRoute{}, map[string][]WebfingerLink{}
+	}
+	// Pre-compressed variants are only selected at the edge in negotiate mode
+	type precompressedEncoding struct {
+		Name   string `json:"name"`
+		Suffix string `json:"suffix"`
+	}
+	precompressedExts := make(map[string]bool)
+	precompressedEncodings := []precompressedEncoding{}
+	if compression := siteCfg.Sync.Compression; compression.Mode == compressionNegotiate {
+		for _, ext := range compression.extensions() {
+			precompressedExts[strings.ToLower(ext)] = true
+		}
+		for _, enc := range compression.encodings() {
+			precompressedEncodings = append(precompressedEncodings, precompressedEncoding{Name: enc, Suffix: encodingSuffixes[enc]})
+		}
+	}
+
+	vars := []functionVar{
+		{"moduleRoutes", routes},
+		{"webfingerRegistry", accounts},
+		{"kvsId", opts.KVSID},
+		{"email", emailAddr},
+		{"canonicalHost", siteCfg.CanonicalHost},
+		{"hosts", buildHostRoutes(siteCfg.Hosts)},
+		{"precompressedExts", precompressedExts},
+		{"precompressedEncodings", precompressedEncodings},
+	}
+
+	// Read template
+	tmplContent, err := os.ReadFile("cmd/lds-site/function.tmpl.js")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read function template: %w", err)
+	}
+	codeStr := string(tmplContent)
+
+	startIndex := strings.Index(codeStr, varsStartMarker)
+	endIndex := strings.Index(codeStr, varsEndMarker)
+	if startIndex == -1 || endIndex == -1 || startIndex >= endIndex {
+		return nil, fmt.Errorf("failed to find vars block in template")
+	}
+	head, tail := codeStr[:startIndex], codeStr[endIndex+len(varsEndMarker):]
+
+	// Generate vars block
+	var sb strings.Builder
+	var sections []functionSection
+	for _, v := range vars {
+		lit, err := jsLiteral(v.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", v.name, err)
+		}
+		line := fmt.Sprintf("var %s = %s;\n", v.name, lit)
+		sections = append(sections, functionSection{Name: v.name, Size: len(line)})
+		sb.WriteString(line)
+	}
+
+	var code string
+	if opts.Minify {
+		// Only the import precedes the vars block in the template. It must
+		// stay the first statement, so the rest is minified as one and placed
+		// after the vars.
+		var imp string
+		if loc := cloudfrontImport.FindStringIndex(head); loc != nil {
+			imp = head[loc[0]:loc[1]] + "\n"
+			head = head[:loc[0]] + head[loc[1]:]
+		}
+		minified, err := minifyFunctionCode(head + tail)
+		if err != nil {
+			return nil, err
+		}
+		code = imp + sb.String() + minified
+		sections = append(sections, functionSection{Name: "template code (minified)", Size: len(imp) + len(minified)})
+	} else {
+		code = head + varsStartMarker + "\n" + sb.String() + varsEndMarker + tail
+		sections = append(sections, functionSection{Name: "template code", Size: len(code) - sb.Len()})
+	}
+
+	if err := checkFunctionCode(code, vars); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sections, func(i, j int) bool {
+		return sections[i].Size > sections[j].Size
+	})
+	return &renderedFunction{Code: []byte(code), Sections: sections}, nil
+}
+
+// functionVar is a value injected into the function's vars block.
+type functionVar struct {
+	name  string
+	value any
+}
+
+// jsLiteral encodes v as a JS expression. JSON is valid JS once U+2028 and
+// U+2029 are escaped, which encoding/json does along with <, > and &, so no
+// value can end the literal early or smuggle in markup.
+func jsLiteral(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// checkFunctionCode parses and evaluates the rendered code, without calling
+// the handler, and checks each injected variable holds exactly the value it
+// was given. CloudFront requires the runtime module import to come first.
+func checkFunctionCode(code string, vars []functionVar) error {
+	if loc := cloudfrontImport.FindStringIndex(code); loc != nil && strings.TrimSpace(code[:loc[0]]) != "" {
+		return fmt.Errorf("rendered function has code before the cloudfront import")
+	}
+	prog, err := goja.Compile("function.js", cloudfrontImport.ReplaceAllString(code, ""), false)
+	if err != nil {
+		return fmt.Errorf("rendered function does not parse: %w", err)
+	}
+	vm := goja.New()
+	if _, err := vm.RunProgram(prog); err != nil {
+		return fmt.Errorf("rendered function fails to load: %w", err)
+	}
+
+	stringify, ok := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	if !ok {
+		return fmt.Errorf("JSON.stringify is not a function")
+	}
+	for _, v := range vars {
+		got, err := stringify(goja.Undefined(), vm.Get(v.name))
+		if err != nil {
+			return fmt.Errorf("failed to read %s from rendered function: %w", v.name, err)
+		}
+		want, err := json.Marshal(v.value)
+		if err != nil {
+			return err
+		}
+		var gotVal, wantVal any
+		if err := json.Unmarshal([]byte(got.String()), &gotVal); err != nil {
+			return fmt.Errorf("failed to read %s from rendered function: %w", v.name, err)
+		}
+		if err := json.Unmarshal(want, &wantVal); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(gotVal, wantVal) {
+			return fmt.Errorf("rendered function has %s = %s, want %s", v.name, got.String(), want)
+		}
+	}
+	return nil
+}
+
+// minifyFunctionCode minifies JS for the CloudFront runtime, which is ES5.1
+// with a selection of later features, so no newer syntax may be introduced.
+func minifyFunctionCode(code string) (string, error) {
+	m := minify.New()
+	m.Add("application/javascript", &js.Minifier{Version: 2009})
+	var out bytes.Buffer
+	if err := m.Minify("application/javascript", &out, strings.NewReader(code)); err != nil {
+		return "", fmt.Errorf("failed to minify function code: %w", err)
+	}
+	return out.String(), nil
+}
+
+// checkSize fails if the function is too big for CloudFront, listing the
+// sections using the most bytes.
+func (f *renderedFunction) checkSize() error {
+	if len(f.Code) <= maxFunctionSize {
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "function is %d bytes, over the CloudFront limit of %d bytes:", len(f.Code), maxFunctionSize)
+	for _, s := range f.Sections {
+		fmt.Fprintf(&sb, "\n  %-26s %6d bytes", s.Name, s.Size)
+	}
+	sb.WriteString("\ntry -minify-function, or move the registries out of the code into a CloudFront KeyValueStore with -kvs-arn")
+	return fmt.Errorf("%s", sb.String())
+}
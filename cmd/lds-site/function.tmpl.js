@@ -1,31 +1,44 @@
+import cf from 'cloudfront';
+
 // Configuration injected by deployment tool
 /* START VARS */
-var moduleRegistry = {};
+var moduleRoutes = {};
 var webfingerRegistry = {};
+var kvsId = "";
 var email = "";
 var canonicalHost = "";
+var hosts = {};
+var precompressedExts = {};
+var precompressedEncodings = [];
 /* END VARS */
 
-function handler(event) {
+async function handler(event) {
     var request = event.request;
     var headers = request.headers;
     var host = headers.host.value;
     var uri = request.uri;
+    var method = request.method;
 
-    // 1. Canonical Host Redirect
-    if (host !== canonicalHost) {
+    // 1. Canonical Host Redirect, keeping the query, unless the host is an
+    // alias that is served. Methods other than GET and HEAD get a 308 so
+    // clients repeat them as-is.
+    var alias = host === canonicalHost ? { serve: true } : hostRoute(host);
+    if (!alias.serve) {
+        var safe = method === "GET" || method === "HEAD";
         return {
-            statusCode: 301,
-            statusDescription: "Moved Permanently",
+            statusCode: safe ? 301 : 308,
+            statusDescription: safe ? "Moved Permanently" : "Permanent Redirect",
             headers: {
-                "location": { "value": "https://" + canonicalHost + uri }
+                "location": { "value": "https://" + canonicalHost + uri + queryString(request.querystring, null) }
             }
         };
     }
 
-
     // 2. Webfinger
     if (uri === "/.well-known/webfinger") {
+        if (method !== "GET" && method !== "HEAD") {
+            return otherMethod(method, true);
+        }
         var query = request.querystring;
         var resource = "";
         if (query.resource && query.resource.value) {
@@ -38,7 +51,7 @@ function handler(event) {
             targetEmail = targetEmail.substring(5);
         }
 
-        var links = webfingerRegistry[targetEmail];
+        var links = await lookup("webfinger", webfingerRegistry, alias.ns ? alias.ns + "/" + targetEmail : targetEmail);
 
         if (links) {
             var response = {
@@ -46,21 +59,23 @@ function handler(event) {
                 links: links
             };
 
-            return {
+            // Webfinger is meant to be readable from browsers on any origin
+            return forMethod(method, {
                 statusCode: 200,
                 statusDescription: "OK",
                 headers: {
-                    "content-type": { "value": "application/json" }
+                    "content-type": { "value": "application/json" },
+                    "access-control-allow-origin": { "value": "*" }
                 },
                 body: {
                     encoding: "text",
                     data: JSON.stringify(response)
                 }
-            };
+            });
         }
-        
+
         // If not found, return 404.
-        return {
+        return forMethod(method, {
             statusCode: 404,
             statusDescription: "Not Found",
              headers: {
@@ -70,82 +85,183 @@ function handler(event) {
                 encoding: "text",
                 data: "Not Found"
             }
-        };
+        });
     }
 
     // 3. Go Modules
-    var keys = Object.keys(moduleRegistry).sort(function(a, b) {
-        return moduleRegistry[b].Path.length - moduleRegistry[a].Path.length;
-    });
-
-    for (var i = 0; i < keys.length; i++) {
-        var key = keys[i];
-        var mod = moduleRegistry[key];
-        var modPath = "/" + key; // e.g. /oauth2ext
-
-            // Check if request is for this module (exact or subpath)
-            if (uri === modPath || uri.indexOf(modPath + "/") === 0) {
-                var query = request.querystring;
-                
-                // Determine redirect target
-                // Default: pkg.go.dev
-                var targetBase = "https://pkg.go.dev/" + mod.Path;
-                var isFixed = false;
-                
-                if (mod.RedirectTo && mod.RedirectTo !== "") {
-                    targetBase = mod.RedirectTo;
-                    isFixed = true;
-                }
+    // Routes are precomputed at deploy time, keyed by first path segment and
+    // ordered longest prefix first. Hosts with their own domain look them up
+    // under their namespace.
+    var slash = uri.indexOf("/", 1);
+    var seg = slash === -1 ? uri.substring(1) : uri.substring(1, slash);
+    var routes = await lookup("module", moduleRoutes, alias.ns ? alias.ns + "/" + seg : seg);
+    if (routes) {
+        for (var i = 0; i < routes.length; i++) {
+            var route = routes[i];
+            if (uri !== route.prefix && uri.indexOf(route.prefix + "/") !== 0) {
+                continue;
+            }
+            if (method !== "GET" && method !== "HEAD") {
+                return otherMethod(method, false);
+            }
 
-                // If go-get=1, return meta tags
-                if (query["go-get"] && query["go-get"].value === "1") {
-                    var html = '<!DOCTYPE html>';
-                    html += '<html lang="en">';
-                    html += '<head>';
-                    html += '<meta charset="UTF-8">';
-                    
-                    var importContent = mod.Path + ' git ' + mod.GitURL;
-                    if (mod.SubDir) {
-                        importContent += ' ' + mod.SubDir;
+            // If go-get=1, return meta tags
+            var goGet = request.querystring["go-get"];
+            if (goGet && goGet.value === "1") {
+                return forMethod(method, {
+                    statusCode: 200,
+                    statusDescription: "OK",
+                    headers: {
+                        "content-type": { "value": "text/html; charset=utf-8" }
+                    },
+                    body: {
+                        encoding: "text",
+                        data: '<!DOCTYPE html><html lang="en"><head><meta charset="UTF-8">' +
+                            '<meta name="go-import" content="' + escapeHTML(route.goImport) + '">' +
+                            '<meta http-equiv="refresh" content="0; url=' + escapeHTML(route.target) + '">' +
+                            '</head><body>Redirecting to <a href="' + escapeHTML(route.target) + '">' + escapeHTML(route.target) + '</a>...</body></html>'
                     }
-                    html += '<meta name="go-import" content="' + importContent + '">';
-                    
-                    html += '<meta http-equiv="refresh" content="0; url=' + targetBase + '">';
-                    html += '</head>';
-                    html += '<body>';
-                    html += 'Redirecting to <a href="' + targetBase + '">' + targetBase + '</a>...';
-                    html += '</body></html>';
-
-                    return {
-                        statusCode: 200,
-                        statusDescription: "OK",
-                        headers: {
-                            "content-type": { "value": "text/html; charset=utf-8" }
-                        },
-                        body: {
-                            encoding: "text",
-                            data: html
-                        }
-                    };
-                }
+                });
+            }
+
+            // Browser Redirect. pkg.go.dev gets the subpath and query (e.g.
+            // ?tab=versions), a fixed redirect_to is used as is.
+            var finalTarget = route.target;
+            if (!route.fixed) {
+                finalTarget += uri.substring(route.prefix.length) + queryString(request.querystring, "go-get");
+            }
 
-                // Browser Redirect
-                var finalTarget = targetBase;
-                if (!isFixed) {
-                     // If not fixed, append subpath for pkg.go.dev
-                     var suffix = uri.substring(modPath.length);
-                     finalTarget = targetBase + suffix;
+            return {
+                statusCode: 302,
+                statusDescription: "Found",
+                headers: {
+                    "location": { "value": finalTarget }
                 }
+            };
+        }
+    }
 
-                return {
-                    statusCode: 302,
-                    statusDescription: "Found",
-                    headers: {
-                        "location": { "value": finalTarget }
-                    }
-                };
-            }
+    // 4. Landing page of a host with its own domain
+    if (alias.page && (uri === "/" || uri === "/index.html")) {
+        uri = alias.page;
+        request.uri = uri;
+    }
+
+    // 5. Pre-compressed static assets
+    var variant = precompressedVariant(uri, headers);
+    if (variant) {
+        request.uri = variant;
     }
 
     return request;
 }
+
+// hostRoute returns how an alias host is handled, matching it exactly or else
+// against a "*." wildcard for its parent domain. Unlisted hosts redirect.
+function hostRoute(host) {
+    if (Object.prototype.hasOwnProperty.call(hosts, host)) {
+        return hosts[host];
+    }
+    var wildcard = "*" + host.substring(host.indexOf("."));
+    if (host.indexOf(".") > 0 && Object.prototype.hasOwnProperty.call(hosts, wildcard)) {
+        return hosts[wildcard];
+    }
+    return { serve: false };
+}
+
+// lookup returns an entry from one of the registries: from the KeyValueStore as
+// "<registry>:<name>" if one is configured, otherwise from the inlined copy.
+// Missing entries are undefined.
+async function lookup(registry, inlined, name) {
+    if (!kvsId) {
+        return Object.prototype.hasOwnProperty.call(inlined, name) ? inlined[name] : undefined;
+    }
+    try {
+        return await cf.kvs(kvsId).get(registry + ":" + name, { format: "json" });
+    } catch (e) {
+        // get rejects for keys that don't exist
+        return undefined;
+    }
+}
+
+// queryString rebuilds the request's query string, including the leading "?",
+// leaving out the skip parameter. Values are still URL-encoded as received.
+function queryString(querystring, skip) {
+    var parts = [];
+    for (var name in querystring) {
+        if (name === skip) {
+            continue;
+        }
+        var param = querystring[name];
+        if (param.multiValue) {
+            for (var i = 0; i < param.multiValue.length; i++) {
+                parts.push(name + "=" + param.multiValue[i].value);
+            }
+        } else {
+            parts.push(name + "=" + param.value);
+        }
+    }
+    return parts.length > 0 ? "?" + parts.join("&") : "";
+}
+
+// forMethod drops the body of a response to a HEAD request.
+function forMethod(method, response) {
+    if (method === "HEAD") {
+        delete response.body;
+    }
+    return response;
+}
+
+// otherMethod answers methods other than GET and HEAD on routes the function
+// serves: OPTIONS lists what is allowed, anything else is refused.
+function otherMethod(method, cors) {
+    var headers = { "allow": { "value": "GET, HEAD, OPTIONS" } };
+    if (cors) {
+        headers["access-control-allow-origin"] = { "value": "*" };
+        headers["access-control-allow-methods"] = { "value": "GET, HEAD, OPTIONS" };
+    }
+    if (method === "OPTIONS") {
+        return { statusCode: 204, statusDescription: "No Content", headers: headers };
+    }
+    return { statusCode: 405, statusDescription: "Method Not Allowed", headers: headers };
+}
+
+// escapeHTML escapes s for use in HTML text and quoted attribute values.
+function escapeHTML(s) {
+    return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+        .replace(/"/g, "&#34;").replace(/'/g, "&#39;");
+}
+
+// precompressedVariant returns the URI of the stored variant of uri for the
+// most preferred encoding the viewer accepts, or null to serve the original.
+function precompressedVariant(uri, headers) {
+    if (precompressedEncodings.length === 0 || !headers["accept-encoding"]) {
+        return null;
+    }
+
+    var path = uri;
+    if (path.charAt(path.length - 1) === "/") {
+        path += "index.html";
+    }
+    var dot = path.lastIndexOf(".");
+    if (dot <= path.lastIndexOf("/") || !precompressedExts[path.substring(dot).toLowerCase()]) {
+        return null;
+    }
+
+    var accepted = headers["accept-encoding"].value.split(",");
+    for (var i = 0; i < precompressedEncodings.length; i++) {
+        var enc = precompressedEncodings[i];
+        for (var j = 0; j < accepted.length; j++) {
+            var parts = accepted[j].split(";");
+            if (parts[0].trim().toLowerCase() !== enc.name) {
+                continue;
+            }
+            // An explicit q=0 means the encoding is not acceptable
+            if (parts.length > 1 && /^q=0(\.0*)?$/.test(parts[1].trim())) {
+                continue;
+            }
+            return path + enc.suffix;
+        }
+    }
+    return null;
+}
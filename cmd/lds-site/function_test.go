@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+// FuzzRenderFunction renders the function with arbitrary config values and
+// requires the code to parse and hold exactly those values.
+func FuzzRenderFunction(f *testing.F) {
+	f.Add("me@example.com", "lds.li", "web", "lds.li/web", "https://github.com/lstoll/web", "", "", false)
+	f.Add("a\"b@example.com", "lds.li", "x", `lds.li/x"; alert(1); "`, "https://example.com/</script>", "https://example.com/?a=1&b='", "sub'dir", true)
+	f.Add(" @ ", "*/ host /*", "a/b", "`${x}`", "javascript:alert(1)", "<!--", "\\", false)
+	f.Add("\xff\xfe", "", "", "", "", "", "", true)
+
+	f.Fuzz(func(t *testing.T, emailAddr, host, key, path, gitURL, redirectTo, subDir string, minify bool) {
+		// The template is read relative to the repository root
+		t.Chdir("../..")
+
+		cfg := &SiteConfig{
+			CanonicalHost: host,
+			Modules: map[string]ModuleConfig{
+				key: {Path: path, GitURL: gitURL, RedirectTo: redirectTo, SubDir: subDir},
+			},
+			Webfinger: map[string][]WebfingerLink{
+				"%%EMAIL%%": {{Rel: "http://openid.net/specs/connect/1.0/issuer", Href: gitURL}},
+			},
+		}
+		fn, err := renderFunction(cfg, emailAddr, renderOptions{Minify: minify})
+		if err != nil {
+			t.Fatalf("renderFunction: %v", err)
+		}
+
+		if err := checkFunctionCode(string(fn.Code), []functionVar{
+			{"email", emailAddr},
+			{"canonicalHost", host},
+			{"moduleRoutes", buildModuleRoutes(cfg.Modules)},
+			{"webfingerRegistry", cfg.webfingerAccounts(emailAddr)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -1,108 +1,228 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
-	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
-	"github.com/lstoll/lds.li/internal/email"
+	"github.com/dop251/goja"
+	"github.com/lstoll/lds.li/email"
 )
 
-func runGenerate(ctx context.Context, logger *slog.Logger, args []string) {
-	fs := flag.NewFlagSet("generate", flag.ExitOnError)
-	outDir := fs.String("out", "build", "Output directory")
-	emailAddr := fs.String("email", os.Getenv("EMAIL_ADDRESS"), "Email address to encrypt")
-	fs.Parse(args)
-	
-	if err := parseEnvFlags(fs); err != nil {
-		logger.Error("Failed to parse env flags", "error", err)
-		os.Exit(1)
+var generateCommand = &command{
+	name:    "generate",
+	summary: "Generate the static site",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		build := addBuildFlags(fs, false)
+		outDir := fs.String("out", "build", "Output directory")
+		return func(ctx context.Context, logger *slog.Logger) error {
+			return runGenerate(ctx, logger, site, build, *outDir)
+		}
+	},
+}
+
+func runGenerate(ctx context.Context, logger *slog.Logger, site *siteOptions, build *buildOptions, outDir string) error {
+	if site.Email == "" {
+		return fmt.Errorf("email address is required (via -email or EMAIL_ADDRESS)")
 	}
 
-	if *emailAddr == "" {
-		logger.Error("Email address is required (via -email or EMAIL_ADDRESS)")
-		os.Exit(1)
+	siteCfg, err := site.loadConfig()
+	if err != nil {
+		return err
 	}
 
-	if err := generateSite(ctx, logger, *outDir, *emailAddr); err != nil {
-		logger.Error("Generation failed", "error", err)
-		os.Exit(1)
+	secrets, err := siteCfg.secretValues(site.Email)
+	if err != nil {
+		return fmt.Errorf("failed to resolve secrets: %w", err)
 	}
+
+	return generateSite(ctx, logger, outDir, secrets, siteCfg.Hosts, siteCfg.Email.options(build.EmailSeed), build.Minify)
+}
+
+// pageData is passed to the site templates
+type pageData struct {
+	// Secrets holds the encrypted contact details, keyed by name
+	Secrets map[string]email.Data
+}
+
+// hostPageData is passed to the landing page template of a host with its own
+// domain
+type hostPageData struct {
+	Host    string
+	Title   string
+	Modules []hostPageModule
 }
 
-func generateSite(ctx context.Context, logger *slog.Logger, outDir, emailAddr string) error {
+// hostPageModule is a module listed on a host landing page
+type hostPageModule struct {
+	Name string // Module key, e.g. "tool"
+	Path string // Import path, e.g. "go.example.org/tool"
+	Docs string // Where the module's browser redirect goes
+}
+
+func generateSite(ctx context.Context, logger *slog.Logger, outDir string, secrets map[string]string, hosts map[string]HostConfig, emailOpts email.Options, minify bool) error {
 	if err := os.MkdirAll(outDir, 0755); err != nil {
 		return fmt.Errorf("failed to create output directory: %w", err)
 	}
 
-	// Generate Email Data
-	emailData := email.GenerateData(emailAddr)
-	logger.Info("Generated email data", "email", emailAddr)
+	// Generate Secret Data
+	secretData, err := email.GenerateSet(ctx, secrets, emailOpts)
+	if err != nil {
+		return fmt.Errorf("failed to generate secret data: %w", err)
+	}
+	data := pageData{Secrets: secretData}
+	for name, d := range data.Secrets {
+		logger.Info("Generated secret data", "name", name, "work", d.Work, "difficulty_bits", d.DifficultyBits)
+	}
+
+	var minifier *siteMinifier
+	if minify {
+		minifier = newSiteMinifier(logger)
+	}
 
-	// Render Index
-	tmpl, err := template.ParseFiles("templates/index.tmpl.html")
+	// Copy and fingerprint static assets first, so templates can reference them
+	manifest, err := buildStatic("static", outDir, minifier)
 	if err != nil {
-		return fmt.Errorf("failed to parse template: %w", err)
+		return fmt.Errorf("failed to build static assets: %w", err)
 	}
+	logger.Info("Copied and fingerprinted static assets", "count", len(manifest))
 
-	outFile, err := os.Create(filepath.Join(outDir, "index.html"))
+	// Render Index
+	tmpl, err := template.New("index.tmpl.html").Funcs(template.FuncMap{
+		"asset": manifest.url,
+	}).ParseFiles("templates/index.tmpl.html")
 	if err != nil {
-		return fmt.Errorf("failed to create index.html: %w", err)
+		return fmt.Errorf("failed to parse template: %w", err)
 	}
-	defer outFile.Close()
 
-	if err := tmpl.Execute(outFile, emailData); err != nil {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
 		return fmt.Errorf("failed to execute template: %w", err)
 	}
+	index, err := minifier.file("index.html", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	// Check the page as written, as minifying rewrites the script
+	if err := verifySecrets(index, secrets); err != nil {
+		return fmt.Errorf("rendered secrets failed verification: %w", err)
+	}
+	logger.Info("Verified rendered secrets", "count", len(secrets))
+	if err := os.WriteFile(filepath.Join(outDir, "index.html"), index, 0644); err != nil {
+		return fmt.Errorf("failed to write index.html: %w", err)
+	}
 	logger.Info("Generated index.html")
 
-	// Copy Static
-	if err := copyDir("static", filepath.Join(outDir, "static")); err != nil {
-		return fmt.Errorf("failed to copy static assets: %w", err)
+	if err := generateHostPages(logger, outDir, hosts, manifest, minifier); err != nil {
+		return err
 	}
-	logger.Info("Copied static assets")
 
 	return nil
 }
 
-func copyDir(src, dst string) error {
-	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+// generateHostPages renders a landing page listing the modules of each host
+// with its own domain, where the CloudFront function serves it for "/".
+func generateHostPages(logger *slog.Logger, outDir string, hosts map[string]HostConfig, manifest assetManifest, minifier *siteMinifier) error {
+	tmpl, err := template.New("host.tmpl.html").Funcs(template.FuncMap{
+		"asset": manifest.url,
+	}).ParseFiles("templates/host.tmpl.html")
+	if err != nil {
+		return fmt.Errorf("failed to parse host template: %w", err)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(hosts)) {
+		host := hosts[name]
+		if !host.ownDomain() {
+			continue
+		}
+		data := hostPageData{Host: name, Title: host.Title}
+		if data.Title == "" {
+			data.Title = name
+		}
+		for _, key := range slices.Sorted(maps.Keys(host.Modules)) {
+			mod := host.Modules[key]
+			docs := "https://pkg.go.dev/" + mod.Path
+			if mod.RedirectTo != "" {
+				docs = mod.RedirectTo
+			}
+			data.Modules = append(data.Modules, hostPageModule{Name: key, Path: mod.Path, Docs: docs})
 		}
 
-		relPath, err := filepath.Rel(src, path)
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return fmt.Errorf("failed to execute host template for %s: %w", name, err)
+		}
+		dir := filepath.Join(outDir, hostPagesDir, name)
+		page, err := minifier.file(filepath.Join(hostPagesDir, name, "index.html"), buf.Bytes())
 		if err != nil {
 			return err
 		}
-		dstPath := filepath.Join(dst, relPath)
-
-		if info.IsDir() {
-			return os.MkdirAll(dstPath, info.Mode())
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create host page directory: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), page, 0644); err != nil {
+			return fmt.Errorf("failed to write landing page for %s: %w", name, err)
 		}
+		logger.Info("Generated host landing page", "host", name, "modules", len(data.Modules))
+	}
+	return nil
+}
 
-		srcFile, err := os.Open(path)
-		if err != nil {
-			return err
+// verifySecrets checks that every secret embedded in the rendered page can be
+// revealed to its original value, by evaluating the page script to read its
+// secrets object and running the Go mirror of the browser algorithm on it.
+// The script is evaluated rather than searched, so it works when minified.
+func verifySecrets(rendered []byte, secrets map[string]string) error {
+	var script string
+	for _, block := range strings.Split(string(rendered), "<script>")[1:] {
+		if s, _, ok := strings.Cut(block, "</script>"); ok && strings.Contains(s, "secrets") {
+			script = s
+			break
 		}
-		defer srcFile.Close()
+	}
+	if script == "" {
+		return fmt.Errorf("secrets script not found in rendered page")
+	}
 
-		dstFile, err := os.Create(dstPath)
+	vm := goja.New()
+	// Enough of a document for the script to load without revealing anything
+	if _, err := vm.RunString(`var document = { readyState: "loading", addEventListener: function () {} };`); err != nil {
+		return err
+	}
+	if _, err := vm.RunString(script); err != nil {
+		return fmt.Errorf("rendered page script fails to load: %w", err)
+	}
+	v, err := vm.RunString("JSON.stringify(secrets)")
+	if err != nil {
+		return fmt.Errorf("failed to read rendered secrets: %w", err)
+	}
+	var embedded map[string]email.Data
+	if err := json.Unmarshal([]byte(v.String()), &embedded); err != nil {
+		return fmt.Errorf("failed to decode rendered secrets: %w", err)
+	}
+
+	for name, want := range secrets {
+		data, ok := embedded[name]
+		if !ok {
+			return fmt.Errorf("secret %s missing from rendered page", name)
+		}
+		got, err := email.Reveal(data)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to reveal secret %s: %w", name, err)
 		}
-		defer dstFile.Close()
-
-		if _, err := io.Copy(dstFile, srcFile); err != nil {
-			return err
+		if got != want {
+			return fmt.Errorf("secret %s revealed to a different value", name)
 		}
-
-		return os.Chmod(dstPath, info.Mode())
-	})
+	}
+	return nil
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore"
+	kvstypes "github.com/aws/aws-sdk-go-v2/service/cloudfrontkeyvaluestore/types"
+)
+
+// KeyValueStore limits, and the most keys changed in one UpdateKeys call
+const (
+	maxKVSKeySize   = 512
+	maxKVSValueSize = 1024
+	kvsUpdateBatch  = 50
+)
+
+// Prefixes of the KeyValueStore keys this tool owns. Other keys in the store
+// are left alone.
+const (
+	kvsModulePrefix    = "module:"
+	kvsWebfingerPrefix = "webfinger:"
+)
+
+var kvsCommand = &command{
+	name:        "kvs",
+	summary:     "Manage the CloudFront KeyValueStore holding the registries",
+	subcommands: []*command{kvsSyncCommand},
+}
+
+var kvsSyncCommand = &command{
+	name:    "sync",
+	summary: "Push module and webfinger registry changes to the KeyValueStore",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		opts := addKVSFlags(fs)
+		dryRun := fs.Bool("dry-run", false, "Report what would be changed without changing anything")
+		awsAuth := addAWSAuthFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			if opts.ARN == "" {
+				return fmt.Errorf("KeyValueStore ARN is required")
+			}
+			if site.Email == "" {
+				return fmt.Errorf("email address is required")
+			}
+			siteCfg, err := site.loadConfig()
+			if err != nil {
+				return err
+			}
+			cfg, err := awsAuth.Load(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load AWS config: %w", err)
+			}
+			return doKVSSync(ctx, logger, cfg, siteCfg, site.Email, opts, *dryRun)
+		}
+	},
+}
+
+// kvsIDFromARN returns the ID the function uses to open a KeyValueStore, the
+// last part of its ARN (arn:aws:cloudfront::<account-id>:key-value-store/<id>).
+func kvsIDFromARN(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+// kvsEntries returns the registries as KeyValueStore entries, in the form the
+// function's lookup reads: module routes as "module:<first path segment>",
+// and webfinger links as "webfinger:<account>", with JSON values. Hosts with
+// their own domain have "<host>/" before the segment or account.
+func kvsEntries(siteCfg *SiteConfig, emailAddr string) (map[string]string, error) {
+	entries := make(map[string]string)
+	add := func(key string, v any) error {
+		value, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", key, err)
+		}
+		if len(key) > maxKVSKeySize {
+			return fmt.Errorf("key %s is over the KeyValueStore limit of %d bytes", key, maxKVSKeySize)
+		}
+		if len(value) > maxKVSValueSize {
+			return fmt.Errorf("value for %s is %d bytes, over the KeyValueStore limit of %d bytes", key, len(value), maxKVSValueSize)
+		}
+		entries[key] = string(value)
+		return nil
+	}
+
+	for seg, routes := range siteModuleRoutes(siteCfg) {
+		if err := add(kvsModulePrefix+seg, routes); err != nil {
+			return nil, err
+		}
+	}
+	for account, links := range siteWebfingerAccounts(siteCfg, emailAddr) {
+		if err := add(kvsWebfingerPrefix+account, links); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func ownedKVSKey(key string) bool {
+	return strings.HasPrefix(key, kvsModulePrefix) || strings.HasPrefix(key, kvsWebfingerPrefix)
+}
+
+// doKVSSync makes the KeyValueStore match the registries in the site config,
+// writing only the keys that changed. Only keys with the registry prefixes
+// are deleted. With dryRun the changes are only logged.
+func doKVSSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, siteCfg *SiteConfig, emailAddr string, opts *kvsOptions, dryRun bool) error {
+	want, err := kvsEntries(siteCfg, emailAddr)
+	if err != nil {
+		return err
+	}
+
+	client := cloudfrontkeyvaluestore.NewFromConfig(cfg)
+	descOut, err := client.DescribeKeyValueStore(ctx, &cloudfrontkeyvaluestore.DescribeKeyValueStoreInput{
+		KvsARN: &opts.ARN,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe KeyValueStore %s: %w", opts.ARN, err)
+	}
+	etag := descOut.ETag
+
+	existing := make(map[string]string)
+	paginator := cloudfrontkeyvaluestore.NewListKeysPaginator(client, &cloudfrontkeyvaluestore.ListKeysInput{
+		KvsARN: &opts.ARN,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list keys: %w", err)
+		}
+		for _, item := range page.Items {
+			existing[*item.Key] = *item.Value
+		}
+	}
+
+	var puts []kvstypes.PutKeyRequestListItem
+	var deletes []kvstypes.DeleteKeyRequestListItem
+	for _, key := range slices.Sorted(maps.Keys(want)) {
+		if old, ok := existing[key]; ok && old == want[key] {
+			continue
+		}
+		logger.Info("Putting key", "key", key, "dry_run", dryRun)
+		puts = append(puts, kvstypes.PutKeyRequestListItem{Key: aws.String(key), Value: aws.String(want[key])})
+	}
+	for _, key := range slices.Sorted(maps.Keys(existing)) {
+		if _, ok := want[key]; ok || !ownedKVSKey(key) {
+			continue
+		}
+		logger.Info("Deleting key", "key", key, "dry_run", dryRun)
+		deletes = append(deletes, kvstypes.DeleteKeyRequestListItem{Key: aws.String(key)})
+	}
+
+	if len(puts) == 0 && len(deletes) == 0 {
+		logger.Info("KeyValueStore is up to date", "keys", len(existing))
+		return nil
+	}
+	if dryRun {
+		logger.Info("Dry run complete, no changes made", "puts", len(puts), "deletes", len(deletes))
+		return nil
+	}
+
+	// Each update must name the store version it applies to
+	for len(puts) > 0 || len(deletes) > 0 {
+		input := &cloudfrontkeyvaluestore.UpdateKeysInput{
+			KvsARN:  &opts.ARN,
+			IfMatch: etag,
+		}
+		n := min(len(puts), kvsUpdateBatch)
+		input.Puts, puts = puts[:n], puts[n:]
+		n = min(len(deletes), kvsUpdateBatch-len(input.Puts))
+		input.Deletes, deletes = deletes[:n], deletes[n:]
+
+		out, err := client.UpdateKeys(ctx, input)
+		if err != nil {
+			return fmt.Errorf("failed to update keys: %w", err)
+		}
+		etag = out.ETag
+	}
+
+	logger.Info("KeyValueStore synced")
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+
+	"github.com/dop251/goja"
+)
+
+// cloudfrontImport is the function's import of the CloudFront runtime module,
+// which the local runner replaces with a stand-in.
+var cloudfrontImport = regexp.MustCompile(`import\s+cf\s+from\s*['"]cloudfront['"];?`)
+
+// localRuntimeJS stands in for the CloudFront runtime: console logging and an
+// in-memory KeyValueStore backed by __kvs.
+const localRuntimeJS = `
+var console = { log: function () { __log(Array.prototype.join.call(arguments, " ")); } };
+var cf = {
+    kvs: function () {
+        return {
+            get: function (key, opts) {
+                return new Promise(function (resolve, reject) {
+                    if (!Object.prototype.hasOwnProperty.call(__kvs, key)) {
+                        reject(new Error("Key " + key + " not found"));
+                        return;
+                    }
+                    var value = __kvs[key];
+                    resolve(opts && opts.format === "json" ? JSON.parse(value) : value);
+                });
+            },
+            exists: function (key) {
+                return Promise.resolve(Object.prototype.hasOwnProperty.call(__kvs, key));
+            }
+        };
+    }
+};
+`
+
+// localFunction runs rendered function code in-process, for testing without
+// deploying. It doesn't measure compute utilization.
+type localFunction struct {
+	prog *goja.Program
+	kvs  map[string]any
+}
+
+// newLocalFunction compiles the function code. kvs holds the KeyValueStore
+// entries the function can read.
+func newLocalFunction(code []byte, kvs map[string]string) (*localFunction, error) {
+	src := localRuntimeJS + cloudfrontImport.ReplaceAllString(string(code), "")
+	prog, err := goja.Compile("function.js", src, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile function: %w", err)
+	}
+	store := make(map[string]any, len(kvs))
+	for k, v := range kvs {
+		store[k] = v
+	}
+	return &localFunction{prog: prog, kvs: store}, nil
+}
+
+// run runs a test case in a fresh runtime. Like runTest, test failures are
+// reported in the result.
+func (f *localFunction) run(ctx context.Context, tc TestCase) (testResult, error) {
+	res := testResult{Name: tc.Name, Utilization: "unknown"}
+
+	eventBytes, err := buildEvent(tc.Request)
+	if err != nil {
+		return res, fmt.Errorf("failed to build event for %s: %w", tc.Name, err)
+	}
+
+	vm := goja.New()
+	vm.Set("__kvs", f.kvs)
+	vm.Set("__log", func(line string) { res.Logs = append(res.Logs, line) })
+	vm.Set("__event", string(eventBytes))
+	if _, err := vm.RunProgram(f.prog); err != nil {
+		res.Err = fmt.Errorf("runtime error: %w", err)
+		return res, nil
+	}
+
+	// The handler is async; its promise settles once the script's jobs run.
+	_, err = vm.RunString(`
+var __out, __err;
+Promise.resolve(handler(JSON.parse(__event))).then(
+    function (r) { __out = JSON.stringify(r); },
+    function (e) { __err = String(e); });
+`)
+	if err != nil {
+		res.Err = fmt.Errorf("runtime error: %w", err)
+		return res, nil
+	}
+	if e := vm.Get("__err"); e != nil && !goja.IsUndefined(e) {
+		res.Err = fmt.Errorf("runtime error: %s", e.String())
+		return res, nil
+	}
+	result := vm.Get("__out")
+	if result == nil || goja.IsUndefined(result) {
+		res.Err = fmt.Errorf("handler did not complete")
+		return res, nil
+	}
+
+	// A response has a status code, anything else is the request passed on
+	var resp Response
+	if err := json.Unmarshal([]byte(result.String()), &resp); err != nil {
+		res.Err = fmt.Errorf("invalid output JSON: %w", err)
+		res.Logs = append(res.Logs, "Output: "+result.String())
+		return res, nil
+	}
+	if resp.StatusCode == 0 {
+		resp = Response{URI: resp.URI}
+	}
+
+	if err := tc.Expect.validate(resp); err != nil {
+		res.Err = fmt.Errorf("assertion: %w", err)
+	}
+	return res, nil
+}
+
+// RunLocalTests executes the tests against the rendered function in-process,
+// writing a report if opts asks for one.
+func RunLocalTests(ctx context.Context, code []byte, kvs map[string]string, tests []TestCase, opts *functionTestOptions, logger *slog.Logger) error {
+	fn, err := newLocalFunction(code, kvs)
+	if err != nil {
+		return err
+	}
+	results, err := runSuite(ctx, tests, fn.run, opts, logger)
+	if err != nil {
+		return err
+	}
+	return reportSuite("local", results, opts, logger)
+}
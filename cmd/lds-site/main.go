@@ -2,41 +2,44 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		usage()
-		os.Exit(1)
-	}
+// rootCommand is the full lds-site command tree.
+var rootCommand = &command{
+	name:    "lds-site",
+	summary: "Manage the lds.li site and its CloudFront function.",
+	subcommands: []*command{
+		generateCommand,
+		syncCommand,
+		cfCommand,
+		kvsCommand,
+		modulesCommand,
+		deployCommand,
+		completionCommand,
+	},
+}
 
+func main() {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
 
 	ctx := context.Background()
 
-	switch os.Args[1] {
-	case "generate":
-		runGenerate(ctx, logger, os.Args[2:])
-	case "sync":
-		runSync(ctx, logger, os.Args[2:])
-	case "cf":
-		runCF(ctx, logger, os.Args[2:])
-	case "deploy":
-		runDeployAll(ctx, logger, os.Args[2:])
-	default:
-		usage()
-		os.Exit(1)
+	// Shell completion scripts call back in with the words typed so far
+	if len(os.Args) > 1 && os.Args[1] == "__complete" {
+		for _, c := range rootCommand.complete(os.Args[2:]) {
+			fmt.Println(c)
+		}
+		return
 	}
-}
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: %s <command> [args]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "\nCommands:\n")
-	fmt.Fprintf(os.Stderr, "  generate    Generate the static site\n")
-	fmt.Fprintf(os.Stderr, "  sync        Sync the static site to S3\n")
-	fmt.Fprintf(os.Stderr, "  cf          Manage CloudFront functions\n")
-	fmt.Fprintf(os.Stderr, "  deploy      Shortcut to sync site and deploy function\n")
+	if err := rootCommand.execute(ctx, logger, rootCommand.name, os.Args[1:]); err != nil {
+		if !errors.Is(err, errUsage) {
+			logger.Error("Command failed", "error", err)
+		}
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// fileNameContentTypes maps file names whose extension is missing or too
+// generic to their Content-Type. These are checked before the extension table.
+var fileNameContentTypes = map[string]string{
+	"feed.xml":                   "application/atom+xml",
+	"atproto-did":                "text/plain; charset=utf-8",
+	"apple-app-site-association": "application/json",
+	"host-meta":                  "application/xrd+xml",
+	"host-meta.json":             "application/json",
+	"nodeinfo":                   "application/json",
+	"CNAME":                      "text/plain; charset=utf-8",
+}
+
+// extContentTypes maps lower-cased file extensions to their Content-Type.
+var extContentTypes = map[string]string{
+	// Documents
+	".html":        "text/html; charset=utf-8",
+	".htm":         "text/html; charset=utf-8",
+	".txt":         "text/plain; charset=utf-8",
+	".md":          "text/markdown; charset=utf-8",
+	".csv":         "text/csv; charset=utf-8",
+	".ics":         "text/calendar; charset=utf-8",
+	".asc":         "text/plain; charset=utf-8",
+	".pdf":         "application/pdf",
+	".xml":         "application/xml",
+	".atom":        "application/atom+xml",
+	".rss":         "application/rss+xml",
+	".xsl":         "application/xslt+xml",
+	".json":        "application/json",
+	".jsonld":      "application/ld+json",
+	".webmanifest": "application/manifest+json",
+
+	// Code
+	".css":  "text/css; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".mjs":  "text/javascript; charset=utf-8",
+	".map":  "application/json",
+	".wasm": "application/wasm",
+
+	// Images
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+	".bmp":  "image/bmp",
+
+	// Fonts
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+
+	// Media
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+
+	// Archives
+	".zip": "application/zip",
+	".gz":  "application/gzip",
+	".tar": "application/x-tar",
+}
+
+// resolveContentType returns the Content-Type for the object at key. Known
+// file names and extensions are looked up first, by the name before
+// fingerprinting for assets. Anything else is sniffed from the start of r,
+// which is rewound before returning.
+func resolveContentType(key string, r io.ReadSeeker) (string, error) {
+	name := path.Base(key)
+	if strings.HasPrefix(key, assetsDir+"/") {
+		name = unfingerprintedName(name)
+	}
+	if ct, ok := fileNameContentTypes[name]; ok {
+		return ct, nil
+	}
+	if ct, ok := extContentTypes[strings.ToLower(path.Ext(name))]; ok {
+		return ct, nil
+	}
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("reading %s for content sniffing: %w", key, err)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("rewinding %s: %w", key, err)
+	}
+
+	return sniffContentType(head[:n]), nil
+}
+
+// sniffContentType extends http.DetectContentType with recognition of Atom and
+// RSS feeds, which it reports as generic XML.
+func sniffContentType(data []byte) string {
+	ct := http.DetectContentType(data)
+	if !strings.HasPrefix(ct, "text/xml") {
+		return ct
+	}
+	switch {
+	case bytes.Contains(data, []byte("<feed")):
+		return "application/atom+xml"
+	case bytes.Contains(data, []byte("<rss")):
+		return "application/rss+xml"
+	}
+	return "application/xml"
+}
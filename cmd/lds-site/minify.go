@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	"github.com/tdewolff/minify/v2/js"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+	"github.com/tdewolff/minify/v2/xml"
+)
+
+// siteMinifier minifies generated files by media type and logs the savings for
+// each one. A nil *siteMinifier leaves files unchanged.
+type siteMinifier struct {
+	m      *minify.M
+	logger *slog.Logger
+}
+
+func newSiteMinifier(logger *slog.Logger) *siteMinifier {
+	m := minify.New()
+	// HTML minification covers inline <style> and <script> through the CSS
+	// and JS minifiers registered alongside it.
+	m.Add("text/html", &html.Minifier{
+		KeepDocumentTags: true,
+		KeepEndTags:      true,
+		KeepQuotes:       true,
+	})
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("image/svg+xml", svg.Minify)
+	m.AddFuncRegexp(regexp.MustCompile(`^(application|text)/(x-)?(java|ecma)script$`), js.Minify)
+	m.AddFuncRegexp(regexp.MustCompile(`[/+]json$`), json.Minify)
+	m.AddFuncRegexp(regexp.MustCompile(`[/+]xml$`), xml.Minify)
+	return &siteMinifier{m: m, logger: logger}
+}
+
+// file minifies data according to the type implied by name. Files of types
+// without a minifier are returned as-is.
+func (s *siteMinifier) file(name string, data []byte) ([]byte, error) {
+	if s == nil {
+		return data, nil
+	}
+
+	mediaType, ok := fileNameContentTypes[path.Base(name)]
+	if !ok {
+		mediaType, ok = extContentTypes[strings.ToLower(path.Ext(name))]
+	}
+	if !ok {
+		return data, nil
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+
+	if _, _, fn := s.m.Match(mediaType); fn == nil {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	if err := s.m.Minify(mediaType, &buf, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("minifying %s: %w", name, err)
+	}
+
+	saved := 0.0
+	if len(data) > 0 {
+		saved = 100 * float64(len(data)-buf.Len()) / float64(len(data))
+	}
+	s.logger.Info("Minified", "file", name, "before", len(data), "after", buf.Len(), "saved", fmt.Sprintf("%.1f%%", saved))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var modulesCommand = &command{
+	name:        "modules",
+	summary:     "Manage the Go modules served by the site",
+	subcommands: []*command{modulesDiscoverCommand, modulesCheckCommand},
+}
+
+var modulesDiscoverCommand = &command{
+	name:    "discover",
+	summary: "Find Go modules under the site's host in local clones or on GitHub",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		src := addRepoSourceFlags(fs)
+		host := fs.String("host", "", "Alias host with its own modules to discover modules for (the canonical host if empty)")
+		write := fs.Bool("write", false, "Add new modules to the site config rather than printing them")
+		return func(ctx context.Context, logger *slog.Logger) error {
+			source, err := src.source(false)
+			if err != nil {
+				return err
+			}
+			siteCfg, err := site.loadConfig()
+			if err != nil {
+				return err
+			}
+			return doDiscover(ctx, logger, siteCfg, source, site.ConfigFile, *host, *write)
+		}
+	},
+}
+
+var modulesCheckCommand = &command{
+	name:    "check",
+	summary: "Check each module's repository has a go.mod declaring its path",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		src := addRepoSourceFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			// Module paths don't change with the environment, so check the
+			// config as written
+			siteCfg, err := LoadConfig(site.ConfigFile)
+			if err != nil {
+				return fmt.Errorf("failed to load site config: %w", err)
+			}
+			return doModulesCheck(ctx, logger, siteCfg, src)
+		}
+	},
+}
+
+// discoveredModule is a Go module found in a repository, as it would be
+// configured.
+type discoveredModule struct {
+	Key    string
+	Config ModuleConfig
+	Repo   string
+}
+
+func doDiscover(ctx context.Context, logger *slog.Logger, siteCfg *SiteConfig, source repoSource, configFile, host string, write bool) error {
+	existing := siteCfg.Modules
+	prefix := siteCfg.CanonicalHost
+	if host != "" {
+		hc, ok := siteCfg.Hosts[host]
+		if !ok || hc.Action != hostServe {
+			return fmt.Errorf("host %s is not served in the site config", host)
+		}
+		if strings.HasPrefix(host, "*.") {
+			return fmt.Errorf("modules can't be discovered for wildcard host %s", host)
+		}
+		existing, prefix = hc.Modules, host
+	}
+
+	found, err := discoverModules(ctx, logger, source, prefix, existing)
+	if err != nil {
+		return err
+	}
+
+	var added []discoveredModule
+	for _, m := range found {
+		cur, ok := existing[m.Key]
+		switch {
+		case !ok:
+			added = append(added, m)
+		case cur.Path != m.Config.Path || cur.GitURL != m.Config.GitURL || cur.SubDir != m.Config.SubDir:
+			logger.Warn("Configured module differs from repository, leaving it unchanged", "module", m.Key, "repo", m.Repo,
+				"path", m.Config.Path, "git_url", m.Config.GitURL, "subdir", m.Config.SubDir)
+		default:
+			logger.Info("Module already configured", "module", m.Key)
+		}
+	}
+	logger.Info("Discovered modules", "found", len(found), "new", len(added))
+	if len(added) == 0 {
+		return nil
+	}
+
+	if !write {
+		mapping := &yaml.Node{Kind: yaml.MappingNode}
+		for _, m := range added {
+			mapping.Content = append(mapping.Content, moduleNodes(m.Key, m.Config)...)
+		}
+		out, err := encodeYAML(mapping)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+	}
+
+	if err := addModulesToConfig(configFile, host, added); err != nil {
+		return err
+	}
+	for _, m := range added {
+		logger.Info("Added module to site config", "module", m.Key, "path", m.Config.Path, "repo", m.Repo)
+	}
+	return nil
+}
+
+// majorVersionDir matches a major version subdirectory, e.g. "v2".
+var majorVersionDir = regexp.MustCompile(`^v[2-9][0-9]*$`)
+
+// discoverModules returns the modules under prefix in every repository from
+// source, ordered by key. Major versions are handled as modules check expects:
+// one on a repository's default branch is found under its unversioned path,
+// and one in a major version subdirectory is left out if a found or configured
+// module of the same repository is its parent, as the parent's route already
+// serves it.
+func discoverModules(ctx context.Context, logger *slog.Logger, source repoSource, prefix string, configured map[string]ModuleConfig) ([]discoveredModule, error) {
+	repos, err := source.Repos(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+
+	byKey := make(map[string]discoveredModule)
+	for _, r := range repos {
+		mods, err := source.GoMods(ctx, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read go.mod files of %s: %w", r.Name, err)
+		}
+		paths := make(map[string]string)
+		for dir, data := range mods {
+			modPath := modulePath(data)
+			if parent, v, ok := cutMajorVersion(modPath); ok && path.Base(dir) != v {
+				// A later major version on the default branch, with earlier
+				// ones in tags, is served by the unversioned path's route
+				logger.Info("Default branch has a later major version", "repo", r.Name, "module", parent, "declared", modPath)
+				modPath = parent
+			}
+			paths[dir] = modPath
+		}
+		// servedAt reports whether a module for modPath is found or
+		// configured in dir of this repository
+		servedAt := func(modPath, dir string) bool {
+			if p, ok := paths[dir]; ok && p == modPath {
+				return true
+			}
+			for _, c := range configured {
+				if c.Path == modPath && c.SubDir == dir && httpsGitURL(c.GitURL) == httpsGitURL(r.GitURL) {
+					return true
+				}
+			}
+			return false
+		}
+
+		for _, dir := range slices.Sorted(maps.Keys(paths)) {
+			modPath := paths[dir]
+			if modPath == "" {
+				logger.Warn("No module line in go.mod", "repo", r.Name, "dir", dir)
+				continue
+			}
+			key, ok := strings.CutPrefix(modPath, prefix+"/")
+			if !ok {
+				logger.Debug("Module is not under the host", "repo", r.Name, "module", modPath)
+				continue
+			}
+			if parent, v, ok := cutMajorVersion(modPath); ok && path.Base(dir) == v {
+				parentDir := path.Dir(dir)
+				if parentDir == "." {
+					parentDir = ""
+				}
+				if servedAt(parent, parentDir) {
+					logger.Info("Major version is served by its parent module", "repo", r.Name, "module", modPath)
+					continue
+				}
+			}
+
+			m := discoveredModule{
+				Key:    key,
+				Config: ModuleConfig{Path: modPath, GitURL: r.GitURL, SubDir: dir},
+				Repo:   r.Name,
+			}
+			if err := m.Config.validate(key); err != nil {
+				logger.Warn("Skipping module", "repo", r.Name, "error", err)
+				continue
+			}
+			if prev, ok := byKey[key]; ok {
+				logger.Warn("Module found in more than one repository, keeping the first", "module", modPath, "repo", prev.Repo, "duplicate", r.Name)
+				continue
+			}
+			byKey[key] = m
+		}
+	}
+
+	var found []discoveredModule
+	for _, key := range slices.Sorted(maps.Keys(byKey)) {
+		found = append(found, byKey[key])
+	}
+	return found, nil
+}
+
+// modulePath returns the module path from the module line of a go.mod file, or
+// "" if it has none.
+func modulePath(gomod []byte) string {
+	sc := bufio.NewScanner(bytes.NewReader(gomod))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		rest, ok := strings.CutPrefix(line, "module")
+		if !ok || rest == "" || (rest[0] != ' ' && rest[0] != '\t' && rest[0] != '"') {
+			continue
+		}
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) || strings.HasPrefix(rest, "`") {
+			p, err := strconv.Unquote(rest)
+			if err != nil {
+				return ""
+			}
+			return p
+		}
+		return rest
+	}
+	return ""
+}
+
+// moduleNodes returns the key and value nodes of a module's config entry,
+// leaving out optional settings that aren't set.
+func moduleNodes(key string, m ModuleConfig) []*yaml.Node {
+	value := &yaml.Node{Kind: yaml.MappingNode}
+	for _, kv := range [][2]string{
+		{"path", m.Path},
+		{"git_url", m.GitURL},
+		{"redirect_to", m.RedirectTo},
+		{"subdir", m.SubDir},
+	} {
+		if kv[1] == "" {
+			continue
+		}
+		value.Content = append(value.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: kv[0]},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: kv[1]})
+	}
+	return []*yaml.Node{{Kind: yaml.ScalarNode, Value: key}, value}
+}
+
+// addModulesToConfig adds modules to the site config file, under the site's
+// modules or those of host. The rest of the file, comments included, is kept
+// as it is.
+func addModulesToConfig(configFile, host string, modules []discoveredModule) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", configFile, err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return fmt.Errorf("%s is empty", configFile)
+	}
+
+	parent := doc.Content[0]
+	if host != "" {
+		hostNode := mappingValue(mappingValue(parent, "hosts"), host)
+		if hostNode == nil {
+			return fmt.Errorf("host %s not found in %s", host, configFile)
+		}
+		parent = hostNode
+	}
+	if parent.Kind != yaml.MappingNode {
+		return fmt.Errorf("unexpected structure in %s", configFile)
+	}
+	mods := mappingValue(parent, "modules")
+	if mods == nil {
+		mods = &yaml.Node{Kind: yaml.MappingNode}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "modules"}, mods)
+	}
+	// Block style, even if the modules were written as {}
+	mods.Style = 0
+	for _, m := range modules {
+		mods.Content = append(mods.Content, moduleNodes(m.Key, m.Config)...)
+	}
+
+	out, err := encodeYAML(&doc)
+	if err != nil {
+		return err
+	}
+	// Make sure the result still loads before replacing the file
+	if _, err := parseConfig(out); err != nil {
+		return fmt.Errorf("updated config is invalid: %w", err)
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(configFile, out, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", configFile, err)
+	}
+	return nil
+}
+
+// mappingValue returns the value for key in a YAML mapping node, or nil.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// encodeYAML encodes n with the two space indent site.yaml uses.
+func encodeYAML(n *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(n); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// configuredModule is a module entry in the site config, along with the host
+// it is served on.
+type configuredModule struct {
+	Host   string // e.g., "lds.li"
+	Key    string
+	Config ModuleConfig
+}
+
+// configuredModules returns the site's modules and those of every host with
+// its own, ordered by host and key.
+func configuredModules(cfg *SiteConfig) []configuredModule {
+	var mods []configuredModule
+	for _, key := range slices.Sorted(maps.Keys(cfg.Modules)) {
+		mods = append(mods, configuredModule{Host: cfg.CanonicalHost, Key: key, Config: cfg.Modules[key]})
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Hosts)) {
+		host := cfg.Hosts[name]
+		for _, key := range slices.Sorted(maps.Keys(host.Modules)) {
+			mods = append(mods, configuredModule{Host: name, Key: key, Config: host.Modules[key]})
+		}
+	}
+	return mods
+}
+
+// gitURLKey normalizes a git URL for matching a module's git_url to a
+// repository.
+func gitURLKey(u string) string {
+	return strings.ToLower(httpsGitURL(u))
+}
+
+func doModulesCheck(ctx context.Context, logger *slog.Logger, siteCfg *SiteConfig, src *repoSourceOptions) error {
+	mods := configuredModules(siteCfg)
+	configured := make(map[string]bool)
+	urls := make(map[string]bool)
+	for _, m := range mods {
+		configured[m.Config.Path] = true
+		urls[m.Config.GitURL] = true
+	}
+
+	var source repoSource
+	if src.Dir == "" && src.GitHub == "" {
+		dir, err := os.MkdirTemp("", "lds-site-modules-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		source = &cloneRepos{URLs: slices.Sorted(maps.Keys(urls)), Dir: dir}
+	} else {
+		var err error
+		// go get works with forks and archived repositories alike
+		if source, err = src.source(true); err != nil {
+			return err
+		}
+	}
+
+	repos, err := source.Repos(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list repositories: %w", err)
+	}
+	byURL := make(map[string]repo)
+	for _, r := range repos {
+		byURL[gitURLKey(r.GitURL)] = r
+	}
+
+	// Repositories often hold several modules, so read each once
+	goMods := make(map[string]map[string][]byte)
+	readErrs := make(map[string]error)
+	failed := 0
+	for _, m := range mods {
+		urlKey := gitURLKey(m.Config.GitURL)
+		var problems []string
+		if _, ok := goMods[urlKey]; !ok && readErrs[urlKey] == nil {
+			if r, ok := byURL[urlKey]; !ok {
+				readErrs[urlKey] = fmt.Errorf("repository %s not found", m.Config.GitURL)
+			} else if goMods[urlKey], err = source.GoMods(ctx, r); err != nil {
+				readErrs[urlKey] = err
+			}
+		}
+		if err := readErrs[urlKey]; err != nil {
+			problems = append(problems, err.Error())
+		} else {
+			problems = checkModule(logger, m, goMods[urlKey], configured)
+		}
+
+		if len(problems) > 0 {
+			failed++
+			logger.Error("Module check failed", "host", m.Host, "module", m.Key, "problems", strings.Join(problems, "; "))
+			continue
+		}
+		logger.Info("Module OK", "host", m.Host, "module", m.Key, "path", m.Config.Path)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d modules failed the check", failed, len(mods))
+	}
+	return nil
+}
+
+// checkModule compares a module entry with the go.mod files of its
+// repository, returning what go get would trip over. Major versions that
+// the entry's route can't serve are reported as needing their own entry,
+// unless configured holds their path.
+func checkModule(logger *slog.Logger, m configuredModule, goMods map[string][]byte, configured map[string]bool) []string {
+	var problems []string
+	modPath, subDir := m.Config.Path, m.Config.SubDir
+	if !strings.HasPrefix(m.Host, "*.") && modPath != m.Host+"/"+m.Key {
+		problems = append(problems, fmt.Sprintf("path %s is served at %s/%s", modPath, m.Host, m.Key))
+	}
+
+	where := "the repository root"
+	if subDir != "" {
+		where = "subdir " + subDir
+	}
+	data, ok := goMods[subDir]
+	switch declared := modulePath(data); {
+	case !ok:
+		problems = append(problems, "no go.mod in "+where)
+	case declared == modPath:
+	case isMajorVersionOf(declared, modPath):
+		// Later major versions on the default branch are served by the
+		// same route, with older ones coming from their tags
+		logger.Info("Default branch has a later major version", "module", m.Key, "declared", declared)
+	default:
+		problems = append(problems, fmt.Sprintf("go.mod in %s declares %q", where, declared))
+	}
+
+	for _, dir := range slices.Sorted(maps.Keys(goMods)) {
+		declared := modulePath(goMods[dir])
+		if dir == subDir || !isMajorVersionOf(declared, modPath) {
+			continue
+		}
+		// The go command finds a major version in its own subdirectory of the
+		// module through the same go-import line
+		if dir == path.Join(subDir, path.Base(declared)) {
+			logger.Info("Major version is served by the module's entry", "module", m.Key, "declared", declared)
+			continue
+		}
+		if !configured[declared] {
+			problems = append(problems, fmt.Sprintf("major version %s needs its own entry with subdir %s", declared, dir))
+		}
+	}
+	return problems
+}
+
+// cutMajorVersion splits a major version suffix off a module path, e.g.
+// "lds.li/tool/v2" into "lds.li/tool" and "v2".
+func cutMajorVersion(modPath string) (parent, v string, ok bool) {
+	i := strings.LastIndex(modPath, "/")
+	if i < 0 || !majorVersionDir.MatchString(modPath[i+1:]) {
+		return "", "", false
+	}
+	return modPath[:i], modPath[i+1:], true
+}
+
+// isMajorVersionOf reports whether p is modPath with a major version suffix,
+// e.g. lds.li/web/v2 for lds.li/web.
+func isMajorVersionOf(p, modPath string) bool {
+	v, ok := strings.CutPrefix(p, modPath+"/")
+	return ok && majorVersionDir.MatchString(v)
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// repo is a git repository modules may be found in.
+type repo struct {
+	Name   string // e.g., "oauth2ext"
+	GitURL string // e.g., "https://github.com/lstoll/oauth2ext"
+	Ref    string // Optional, the branch or commit to read
+	Dir    string // Optional, the local clone
+}
+
+// repoSource lists repositories and reads their go.mod files. Discovery only
+// goes through this interface, so local clones, a git host's API or a fake are
+// interchangeable.
+type repoSource interface {
+	Repos(ctx context.Context) ([]repo, error)
+	// GoMods returns the contents of every go.mod in the repository, keyed by
+	// the slash-separated directory holding it, "" for the root.
+	GoMods(ctx context.Context, r repo) (map[string][]byte, error)
+}
+
+// skipModuleDir reports whether the go command ignores a directory when
+// looking for packages, so modules in it aren't published.
+func skipModuleDir(name string) bool {
+	return name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
+
+// localRepos finds repositories among the clones in a directory, or the
+// directory itself if it is a clone.
+type localRepos struct {
+	Dir string
+}
+
+func (l *localRepos) Repos(ctx context.Context) ([]repo, error) {
+	if isGitDir(l.Dir) {
+		r, err := l.repo(ctx, filepath.Base(filepath.Clean(l.Dir)), l.Dir)
+		if err != nil {
+			return nil, err
+		}
+		return []repo{r}, nil
+	}
+
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", l.Dir, err)
+	}
+	var repos []repo
+	for _, e := range entries {
+		dir := filepath.Join(l.Dir, e.Name())
+		if !e.IsDir() || !isGitDir(dir) {
+			continue
+		}
+		r, err := l.repo(ctx, e.Name(), dir)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, r)
+	}
+	return repos, nil
+}
+
+// repo describes the clone in dir, taking its URL from the origin remote.
+func (l *localRepos) repo(ctx context.Context, name, dir string) (repo, error) {
+	out, err := exec.CommandContext(ctx, "git", "-C", dir, "remote", "get-url", "origin").Output()
+	if err != nil {
+		return repo{}, fmt.Errorf("failed to get origin URL of %s: %w", dir, err)
+	}
+	return repo{Name: name, GitURL: httpsGitURL(strings.TrimSpace(string(out))), Dir: dir}, nil
+}
+
+func (l *localRepos) GoMods(ctx context.Context, r repo) (map[string][]byte, error) {
+	return walkGoMods(r.Dir)
+}
+
+// walkGoMods reads the go.mod files in a checkout, keyed by slash-separated
+// directory.
+func walkGoMods(root string) (map[string][]byte, error) {
+	mods := make(map[string][]byte)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && skipModuleDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != "go.mod" {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		mods[filepath.ToSlash(rel)] = data
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find go.mod files in %s: %w", root, err)
+	}
+	return mods, nil
+}
+
+// cloneRepos makes shallow clones of the given git URLs in a scratch
+// directory, for when there is neither a local mirror nor an API to read from.
+type cloneRepos struct {
+	URLs []string
+	Dir  string // Scratch directory for the clones
+}
+
+func (c *cloneRepos) Repos(ctx context.Context) ([]repo, error) {
+	var repos []repo
+	for _, u := range c.URLs {
+		repos = append(repos, repo{Name: u, GitURL: u})
+	}
+	return repos, nil
+}
+
+func (c *cloneRepos) GoMods(ctx context.Context, r repo) (map[string][]byte, error) {
+	dir, err := os.MkdirTemp(c.Dir, "clone-")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "git", "clone", "--quiet", "--depth", "1", r.GitURL, dir)
+	// Fail rather than wait for credentials
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to clone %s: %w: %s", r.GitURL, err, strings.TrimSpace(string(out)))
+	}
+	return walkGoMods(dir)
+}
+
+func isGitDir(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// httpsGitURL returns the https form of a git remote URL, without credentials
+// or a .git suffix, as go-import git URLs are written in the site config.
+// SSH remotes such as git@github.com:lstoll/web.git become
+// https://github.com/lstoll/web.
+func httpsGitURL(remote string) string {
+	if !strings.Contains(remote, "://") {
+		// scp-like syntax, [user@]host:path
+		if host, p, ok := strings.Cut(remote, ":"); ok {
+			if i := strings.LastIndex(host, "@"); i >= 0 {
+				host = host[i+1:]
+			}
+			remote = "ssh://" + host + "/" + strings.TrimPrefix(p, "/")
+		}
+	}
+	u, err := url.Parse(remote)
+	if err != nil || u.Host == "" {
+		return remote
+	}
+	u.Scheme = "https"
+	u.User = nil
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+	return u.String()
+}
+
+var errGitHubNotFound = errors.New("not found")
+
+// githubRepos finds repositories belonging to a GitHub user or organization,
+// reading go.mod files through the API without cloning.
+type githubRepos struct {
+	Owner  string // e.g., "lstoll"
+	Token  string // Optional, raises rate limits and lists the authenticated user's or org's private repositories
+	API    string // e.g., "https://api.github.com"
+	Client *http.Client
+	// KeepInactive lists forks and archived repositories too. Discovery skips
+	// them, but modules configured in one can still be fetched.
+	KeepInactive bool
+}
+
+func (g *githubRepos) Repos(ctx context.Context) ([]repo, error) {
+	list, err := g.listPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var repos []repo
+	for page := 1; ; page++ {
+		var batch []struct {
+			Name          string `json:"name"`
+			HTMLURL       string `json:"html_url"`
+			DefaultBranch string `json:"default_branch"`
+			Fork          bool   `json:"fork"`
+			Archived      bool   `json:"archived"`
+		}
+		if err := g.getJSON(ctx, fmt.Sprintf("%s&per_page=100&page=%d", list, page), &batch); err != nil {
+			return nil, err
+		}
+		for _, r := range batch {
+			if (r.Fork || r.Archived) && !g.KeepInactive {
+				continue
+			}
+			repos = append(repos, repo{Name: r.Name, GitURL: r.HTMLURL, Ref: r.DefaultBranch})
+		}
+		if len(batch) < 100 {
+			return repos, nil
+		}
+	}
+}
+
+// listPath returns the API path listing the owner's repositories. The public
+// user listing is the last resort, as it leaves out private repositories even
+// with a token.
+func (g *githubRepos) listPath(ctx context.Context) (string, error) {
+	owner := url.PathEscape(g.Owner)
+	_, err := g.get(ctx, "/orgs/"+owner, "application/vnd.github+json")
+	if err == nil {
+		return "/orgs/" + owner + "/repos?type=all", nil
+	}
+	if !errors.Is(err, errGitHubNotFound) {
+		return "", err
+	}
+
+	if g.Token != "" {
+		var user struct {
+			Login string `json:"login"`
+		}
+		if err := g.getJSON(ctx, "/user", &user); err != nil {
+			return "", err
+		}
+		if strings.EqualFold(user.Login, g.Owner) {
+			return "/user/repos?affiliation=owner", nil
+		}
+	}
+	return "/users/" + owner + "/repos?type=owner", nil
+}
+
+func (g *githubRepos) GoMods(ctx context.Context, r repo) (map[string][]byte, error) {
+	base := "/repos/" + url.PathEscape(g.Owner) + "/" + url.PathEscape(r.Name)
+	var tree struct {
+		Tree []struct {
+			Path string `json:"path"`
+			Type string `json:"type"`
+		} `json:"tree"`
+		Truncated bool `json:"truncated"`
+	}
+	if err := g.getJSON(ctx, base+"/git/trees/"+url.PathEscape(r.Ref)+"?recursive=1", &tree); err != nil {
+		return nil, err
+	}
+	if tree.Truncated {
+		return nil, fmt.Errorf("file list of %s is too large for the GitHub API, use a local clone", r.Name)
+	}
+
+	var paths []string
+	for _, e := range tree.Tree {
+		if e.Type != "blob" || path.Base(e.Path) != "go.mod" {
+			continue
+		}
+		dir := path.Dir(e.Path)
+		if dir == "." {
+			dir = ""
+		}
+		if slices.ContainsFunc(strings.Split(dir, "/"), func(seg string) bool { return seg != "" && skipModuleDir(seg) }) {
+			continue
+		}
+		paths = append(paths, e.Path)
+	}
+	sort.Strings(paths)
+
+	mods := make(map[string][]byte)
+	for _, p := range paths {
+		data, err := g.get(ctx, base+"/contents/"+(&url.URL{Path: p}).EscapedPath()+"?ref="+url.QueryEscape(r.Ref), "application/vnd.github.raw")
+		if err != nil {
+			return nil, err
+		}
+		dir := path.Dir(p)
+		if dir == "." {
+			dir = ""
+		}
+		mods[dir] = data
+	}
+	return mods, nil
+}
+
+func (g *githubRepos) getJSON(ctx context.Context, p string, v any) error {
+	data, err := g.get(ctx, p, "application/vnd.github+json")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode GitHub API response for %s: %w", p, err)
+	}
+	return nil
+}
+
+func (g *githubRepos) get(ctx context.Context, p, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(g.API, "/")+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if g.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.Token)
+	}
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call GitHub API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("GitHub API %s: %w", p, errGitHubNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API %s: %s", p, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GitHub API response for %s: %w", p, err)
+	}
+	return data, nil
+}
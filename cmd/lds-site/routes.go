@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// moduleRoute is a module's routing entry in the CloudFront function,
+// precomputed at deploy time so requests only do map lookups.
+type moduleRoute struct {
+	Prefix   string `json:"prefix"`   // e.g., "/oauth2ext"
+	Target   string `json:"target"`   // Browser redirect target
+	Fixed    bool   `json:"fixed"`    // If false, the request subpath is appended to Target
+	GoImport string `json:"goImport"` // go-import meta tag content
+}
+
+// hostRoute is how the CloudFront function handles an alias host.
+type hostRoute struct {
+	Serve bool `json:"serve"` // If false, redirect to the canonical host
+	// Namespace prefixes the registry keys for a host with its own modules
+	// and webfinger links, e.g. "<namespace>/<first path segment>".
+	Namespace string `json:"ns,omitempty"`
+	Page      string `json:"page,omitempty"` // The host's landing page, served for "/"
+}
+
+// hostPagesDir is where the landing pages of hosts with their own domain are
+// generated, as "<hostPagesDir>/<host>/index.html".
+const hostPagesDir = "_hosts"
+
+// buildHostRoutes returns the alias hosts' routing entries, keyed by host.
+func buildHostRoutes(hosts map[string]HostConfig) map[string]hostRoute {
+	routes := make(map[string]hostRoute)
+	for name, host := range hosts {
+		route := hostRoute{Serve: host.Action == hostServe}
+		if host.ownDomain() {
+			route.Namespace = name
+			route.Page = "/" + hostPagesDir + "/" + name + "/index.html"
+		}
+		routes[name] = route
+	}
+	return routes
+}
+
+// siteModuleRoutes returns the routes for the site's modules and those of every
+// host with its own, keyed as the function looks them up.
+func siteModuleRoutes(cfg *SiteConfig) map[string][]moduleRoute {
+	routes := buildModuleRoutes(cfg.Modules)
+	for name, host := range cfg.Hosts {
+		for seg, rs := range buildModuleRoutes(host.Modules) {
+			routes[name+"/"+seg] = rs
+		}
+	}
+	return routes
+}
+
+// siteWebfingerAccounts returns the webfinger links for the site's accounts
+// and those of every host with its own, keyed as the function looks them up.
+func siteWebfingerAccounts(cfg *SiteConfig, emailAddr string) map[string][]WebfingerLink {
+	accounts := cfg.webfingerAccounts(emailAddr)
+	for name, host := range cfg.Hosts {
+		for account, links := range webfingerAccounts(host.Webfinger, emailAddr) {
+			accounts[name+"/"+account] = links
+		}
+	}
+	return accounts
+}
+
+// buildModuleRoutes returns the module routes keyed by the first path segment
+// they match. Routes sharing a segment are ordered longest prefix first.
+func buildModuleRoutes(modules map[string]ModuleConfig) map[string][]moduleRoute {
+	routes := make(map[string][]moduleRoute)
+	for key, mod := range modules {
+		route := moduleRoute{
+			Prefix: "/" + key,
+			Target: "https://pkg.go.dev/" + mod.Path,
+		}
+		if mod.RedirectTo != "" {
+			route.Target = mod.RedirectTo
+			route.Fixed = true
+		}
+		route.GoImport = mod.Path + " git " + mod.GitURL
+		if mod.SubDir != "" {
+			route.GoImport += " " + mod.SubDir
+		}
+
+		seg, _, _ := strings.Cut(key, "/")
+		routes[seg] = append(routes[seg], route)
+	}
+	for _, rs := range routes {
+		sort.Slice(rs, func(i, j int) bool {
+			if len(rs[i].Prefix) != len(rs[j].Prefix) {
+				return len(rs[i].Prefix) > len(rs[j].Prefix)
+			}
+			return rs[i].Prefix < rs[j].Prefix
+		})
+	}
+	return routes
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -10,53 +11,51 @@ import (
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
 	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func runSync(ctx context.Context, logger *slog.Logger, args []string) {
-	fs := flag.NewFlagSet("sync", flag.ExitOnError)
-	bucket := fs.String("bucket", "", "S3 bucket name")
-	dir := fs.String("dir", "build", "Directory to sync")
-	generate := fs.Bool("generate", true, "Generate site before syncing")
-	emailAddr := fs.String("email", os.Getenv("EMAIL_ADDRESS"), "Email address (required if generate is true)")
-	distributionID := fs.String("distribution-id", "", "CloudFront distribution ID to invalidate")
-
-	awsAuth := addAWSAuthFlags(fs)
-
-	fs.Parse(args)
+var syncCommand = &command{
+	name:    "sync",
+	summary: "Sync the static site to S3",
+	setup: func(fs *flag.FlagSet) runFunc {
+		site := addSiteFlags(fs)
+		opts := addSyncFlags(fs)
+		fs.BoolVar(&opts.DryRun, "dry-run", false, "Report what would be uploaded, deleted and invalidated without changing anything")
+		awsAuth := addAWSAuthFlags(fs)
+		return func(ctx context.Context, logger *slog.Logger) error {
+			cfg, err := awsAuth.Load(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to load AWS config: %w", err)
+			}
+			return doSync(ctx, logger, cfg, site, opts)
+		}
+	},
+}
 
-	if err := parseEnvFlags(fs); err != nil {
-		logger.Error("Failed to parse env flags", "error", err)
-		os.Exit(1)
+func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, site *siteOptions, opts *syncOptions) error {
+	if opts.Bucket == "" {
+		return fmt.Errorf("bucket name is required")
 	}
 
-	cfg, err := awsAuth.Load(ctx)
+	siteCfg, err := site.loadConfig()
 	if err != nil {
-		logger.Error("Failed to load AWS config", "error", err)
-		os.Exit(1)
+		return err
 	}
 
-	if err := doSync(ctx, logger, cfg, *bucket, *dir, *generate, *emailAddr, *distributionID); err != nil {
-		logger.Error("Sync failed", "error", err)
-		os.Exit(1)
-	}
-}
-
-func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, dir string, generate bool, emailAddr, distributionID string) error {
-	if bucket == "" {
-		return fmt.Errorf("bucket name is required")
-	}
-
-	if generate {
-		if emailAddr == "" {
+	if opts.Generate {
+		if site.Email == "" {
 			return fmt.Errorf("email address is required for generation")
 		}
+		secrets, err := siteCfg.secretValues(site.Email)
+		if err != nil {
+			return err
+		}
 		logger.Info("Generating site...")
-		if err := generateSite(ctx, logger, dir, emailAddr); err != nil {
+		if err := generateSite(ctx, logger, opts.Dir, secrets, siteCfg.Hosts, siteCfg.Email.options(opts.Build.EmailSeed), opts.Build.Minify); err != nil {
 			return fmt.Errorf("generation failed: %w", err)
 		}
 	}
@@ -64,12 +63,12 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 	s3Client := s3.NewFromConfig(cfg)
 	uploader := manager.NewUploader(s3Client)
 
-	logger.Info("Syncing directory to S3", "dir", dir, "bucket", bucket)
+	logger.Info("Syncing directory to S3", "dir", opts.Dir, "bucket", opts.Bucket)
 
 	// List existing objects for pruning
 	existingObjects := make(map[string]bool)
 	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
-		Bucket: &bucket,
+		Bucket: &opts.Bucket,
 	})
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(ctx)
@@ -77,12 +76,60 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 			return fmt.Errorf("failed to list objects: %w", err)
 		}
 		for _, obj := range page.Contents {
+			// Cached pages from earlier builds still load their assets
+			if !opts.PruneAssets && strings.HasPrefix(*obj.Key, assetsDir+"/") {
+				continue
+			}
 			existingObjects[*obj.Key] = true
 		}
 	}
 
 	var invalidatedPaths []string
 
+	put := func(key string, body []byte, contentType, contentEncoding string, md objectMetadata) error {
+		// Mark as present locally
+		delete(existingObjects, key)
+
+		if opts.DryRun {
+			logger.Info("Would upload", "key", key, "size", len(body), "content_type", contentType,
+				"content_encoding", contentEncoding, "cache_control", md.CacheControl,
+				"content_disposition", md.ContentDisposition, "storage_class", md.StorageClass,
+				"metadata", md.Metadata)
+			return nil
+		}
+
+		input := &s3.PutObjectInput{
+			Bucket:      &opts.Bucket,
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String(contentType),
+			Metadata:    md.Metadata,
+		}
+		if contentEncoding != "" {
+			input.ContentEncoding = aws.String(contentEncoding)
+		}
+		if md.CacheControl != "" {
+			input.CacheControl = aws.String(md.CacheControl)
+		}
+		if md.ContentDisposition != "" {
+			input.ContentDisposition = aws.String(md.ContentDisposition)
+		}
+		if md.StorageClass != "" {
+			input.StorageClass = s3types.StorageClass(md.StorageClass)
+		}
+
+		logger.Info("Uploading", "key", key, "content_encoding", contentEncoding, "cache_control", md.CacheControl)
+		_, err := uploader.Upload(ctx, input)
+		return err
+	}
+
+	compression := siteCfg.Sync.Compression
+
+	fingerprinted, err := loadFingerprintedKeys(opts.Dir)
+	if err != nil {
+		return err
+	}
+
 	walker := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -91,43 +138,81 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 			return nil
 		}
 
-		relPath, err := filepath.Rel(dir, path)
+		relPath, err := filepath.Rel(opts.Dir, path)
 		if err != nil {
 			return err
 		}
 		// S3 uses / as separator
 		key := filepath.ToSlash(relPath)
 
-		// Mark as present locally
-		delete(existingObjects, key)
-
-		f, err := os.Open(path)
+		data, err := os.ReadFile(path)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
 
-		contentType := getContentType(path)
+		md := siteCfg.Sync.metadataFor(key)
+		contentType := md.ContentType
+		if contentType == "" {
+			contentType, err = resolveContentType(key, bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+		}
 
-		logger.Info("Uploading", "key", key)
-		_, err = uploader.Upload(ctx, &s3.PutObjectInput{
-			Bucket:      &bucket,
-			Key:         aws.String(key),
-			Body:        f,
-			ContentType: aws.String(contentType),
-		})
-		if err != nil {
-			return err
+		// Each local file becomes one or more objects, depending on compression
+		type variant struct {
+			key      string
+			body     []byte
+			encoding string
+		}
+		variants := []variant{{key: key, body: data}}
+		if compression.appliesTo(key) {
+			if compression.Mode == compressionSingle {
+				variants = nil
+			}
+			for _, enc := range compression.encodings() {
+				compressed, err := compress(enc, data)
+				if err != nil {
+					return fmt.Errorf("compressing %s: %w", key, err)
+				}
+				vkey := key
+				if compression.Mode == compressionNegotiate {
+					vkey += encodingSuffixes[enc]
+				}
+				variants = append(variants, variant{key: vkey, body: compressed, encoding: enc})
+			}
+		}
+
+		for _, v := range variants {
+			if err := put(v.key, v.body, contentType, v.encoding, md); err != nil {
+				return err
+			}
+			// Fingerprinted assets change name when their content does, so
+			// cached copies never go stale.
+			if !fingerprinted[key] {
+				invalidatedPaths = append(invalidatedPaths, "/"+v.key)
+			}
 		}
-		invalidatedPaths = append(invalidatedPaths, "/"+key)
 		return nil
 	}
 
-	if err := filepath.Walk(dir, walker); err != nil {
+	if err := filepath.Walk(opts.Dir, walker); err != nil {
 		return fmt.Errorf("failed to walk directory: %w", err)
 	}
 
 	// Prune removed files
+	if opts.DryRun {
+		for key := range existingObjects {
+			logger.Info("Would delete", "key", key)
+			invalidatedPaths = append(invalidatedPaths, "/"+key)
+		}
+		if opts.DistributionID != "" && len(invalidatedPaths) > 0 {
+			logger.Info("Would invalidate CloudFront cache", "distribution_id", opts.DistributionID, "paths", invalidatedPaths)
+		}
+		logger.Info("Dry run complete, no changes made")
+		return nil
+	}
+
 	if len(existingObjects) > 0 {
 		logger.Info("Pruning removed files", "count", len(existingObjects))
 		var toDelete []s3types.ObjectIdentifier
@@ -145,7 +230,7 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 			}
 			batch := toDelete[i:end]
 			_, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-				Bucket: &bucket,
+				Bucket: &opts.Bucket,
 				Delete: &s3types.Delete{
 					Objects: batch,
 				},
@@ -156,8 +241,8 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 		}
 	}
 
-	if distributionID != "" && len(invalidatedPaths) > 0 {
-		logger.Info("Invalidating CloudFront cache", "distribution_id", distributionID, "count", len(invalidatedPaths))
+	if opts.DistributionID != "" && len(invalidatedPaths) > 0 {
+		logger.Info("Invalidating CloudFront cache", "distribution_id", opts.DistributionID, "count", len(invalidatedPaths))
 		cfClient := cloudfront.NewFromConfig(cfg)
 		// CloudFront limits invalidation paths to 3000.
 		// If we have more, we'll batch them.
@@ -168,12 +253,12 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 				end = len(invalidatedPaths)
 			}
 			batch := invalidatedPaths[i:end]
-			
+
 			// Reference ID for the invalidation batch
 			callerRef := fmt.Sprintf("sync-invalidation-%d-%d", os.Getpid(), i)
 
 			_, err := cfClient.CreateInvalidation(ctx, &cloudfront.CreateInvalidationInput{
-				DistributionId: &distributionID,
+				DistributionId: &opts.DistributionID,
 				InvalidationBatch: &types.InvalidationBatch{
 					CallerReference: &callerRef,
 					Paths: &types.Paths{
@@ -192,27 +277,3 @@ func doSync(ctx context.Context, logger *slog.Logger, cfg aws.Config, bucket, di
 	logger.Info("Sync complete")
 	return nil
 }
-
-func getContentType(path string) string {
-	ext := strings.ToLower(filepath.Ext(path))
-	switch ext {
-	case ".html":
-		return "text/html; charset=utf-8"
-	case ".css":
-		return "text/css"
-	case ".js":
-		return "application/javascript"
-	case ".json":
-		return "application/json"
-	case ".png":
-		return "image/png"
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".svg":
-		return "image/svg+xml"
-	case ".xml":
-		return "application/xml"
-	default:
-		return "application/octet-stream"
-	}
-}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// objectMetadata is the resolved set of S3 object properties for a key.
+type objectMetadata struct {
+	ContentType        string
+	CacheControl       string
+	ContentDisposition string
+	StorageClass       string
+	Metadata           map[string]string
+}
+
+// metadataFor resolves the metadata for an object key. Every matching rule is
+// applied in order, so later rules override fields set by earlier ones.
+func (c SyncConfig) metadataFor(key string) objectMetadata {
+	var md objectMetadata
+	for _, r := range c.Rules {
+		if !matchGlob(r.Match, key) {
+			continue
+		}
+		if r.ContentType != "" {
+			md.ContentType = r.ContentType
+		}
+		if r.CacheControl != "" {
+			md.CacheControl = r.CacheControl
+		}
+		if r.ContentDisposition != "" {
+			md.ContentDisposition = r.ContentDisposition
+		}
+		if r.StorageClass != "" {
+			md.StorageClass = r.StorageClass
+		}
+		for k, v := range r.Metadata {
+			if md.Metadata == nil {
+				md.Metadata = make(map[string]string)
+			}
+			md.Metadata[normalizeMetadataKey(k)] = v
+		}
+	}
+	return md
+}
+
+func (c SyncConfig) validate() error {
+	validClasses := make(map[string]bool)
+	for _, sc := range s3types.StorageClass("").Values() {
+		validClasses[string(sc)] = true
+	}
+
+	for i, r := range c.Rules {
+		if r.Match == "" {
+			return fmt.Errorf("sync rule %d: match is required", i)
+		}
+		if _, err := path.Match(strings.ReplaceAll(r.Match, "**", "*"), ""); err != nil {
+			return fmt.Errorf("sync rule %d: invalid match pattern %q: %w", i, r.Match, err)
+		}
+		if r.StorageClass != "" && !validClasses[r.StorageClass] {
+			return fmt.Errorf("sync rule %d: unknown storage class %q", i, r.StorageClass)
+		}
+		for k := range r.Metadata {
+			if normalizeMetadataKey(k) == "" {
+				return fmt.Errorf("sync rule %d: empty metadata key", i)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeMetadataKey strips an optional x-amz-meta- prefix, as the SDK adds
+// it when sending user metadata.
+func normalizeMetadataKey(k string) string {
+	k = strings.ToLower(k)
+	return strings.TrimPrefix(k, "x-amz-meta-")
+}
+
+// matchGlob reports whether key matches pattern. Patterns are matched against
+// the full slash-separated key. A "*" matches within a single path segment,
+// while a "**" segment matches any number of segments, including none.
+func matchGlob(pattern, key string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(key, "/"))
+}
+
+func matchSegments(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(key); i++ {
+				if matchSegments(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(key) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], key[0]); !ok {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Expect is a declarative check of a function's output.
+type Expect struct {
+	Status       int               `yaml:"status"`        // Response status, 0 for the request to pass through
+	Headers      map[string]string `yaml:"headers"`       // Exact response header values
+	URI          string            `yaml:"uri"`           // URI the request passes through with, e.g. after a rewrite
+	NoBody       bool              `yaml:"no_body"`       // The response must have no body, e.g. for HEAD
+	BodyContains []string          `yaml:"body_contains"` // Substrings of the response body
+	BodyExcludes []string          `yaml:"body_excludes"` // Substrings the response body must not contain
+	BodyMatches  []string          `yaml:"body_matches"`  // Regular expressions the response body must match
+	JSON         map[string]any    `yaml:"json"`          // Values in a JSON body by dotted path, e.g. "links.0.href"
+}
+
+// check reports problems with the expectation itself, so a bad test file
+// fails to load rather than failing its tests.
+func (e Expect) check() error {
+	for _, re := range e.BodyMatches {
+		if _, err := regexp.Compile(re); err != nil {
+			return fmt.Errorf("invalid body_matches: %w", err)
+		}
+	}
+	return nil
+}
+
+func (e Expect) validate(resp Response) error {
+	if resp.StatusCode != e.Status {
+		if e.Status == 0 {
+			return fmt.Errorf("expected pass-through (no status code), got %d", resp.StatusCode)
+		}
+		return fmt.Errorf("expected status %d, got %d", e.Status, resp.StatusCode)
+	}
+	if e.URI != "" {
+		var got string
+		if resp.URI != nil {
+			got = *resp.URI
+		}
+		if got != e.URI {
+			return fmt.Errorf("expected request URI %q, got %q", e.URI, got)
+		}
+	}
+	for name, want := range e.Headers {
+		if got := resp.Headers[strings.ToLower(name)].Value; got != want {
+			return fmt.Errorf("expected header %s %q, got %q", name, want, got)
+		}
+	}
+
+	var body string
+	if resp.Body != nil {
+		body = resp.Body.Data
+	}
+	if e.NoBody && resp.Body != nil {
+		return fmt.Errorf("expected no body, got %d bytes", len(body))
+	}
+	for _, sub := range e.BodyContains {
+		if !strings.Contains(body, sub) {
+			return fmt.Errorf("expected body to contain %q", sub)
+		}
+	}
+	for _, sub := range e.BodyExcludes {
+		if strings.Contains(body, sub) {
+			return fmt.Errorf("expected body not to contain %q", sub)
+		}
+	}
+	for _, expr := range e.BodyMatches {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(body) {
+			return fmt.Errorf("expected body to match %q", expr)
+		}
+	}
+
+	if len(e.JSON) == 0 {
+		return nil
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		return fmt.Errorf("expected a JSON body: %w", err)
+	}
+	for path, want := range e.JSON {
+		got, ok := jsonPath(doc, path)
+		if !ok {
+			return fmt.Errorf("expected JSON body to have %s", path)
+		}
+		// Round trip the expected value so its types match the decoded body
+		wantJSON, err := json.Marshal(want)
+		if err != nil {
+			return fmt.Errorf("invalid expected value for %s: %w", path, err)
+		}
+		var wantVal any
+		if err := json.Unmarshal(wantJSON, &wantVal); err != nil {
+			return fmt.Errorf("invalid expected value for %s: %w", path, err)
+		}
+		if !reflect.DeepEqual(got, wantVal) {
+			gotJSON, _ := json.Marshal(got)
+			return fmt.Errorf("expected JSON %s to be %s, got %s", path, wantJSON, gotJSON)
+		}
+	}
+	return nil
+}
+
+// jsonPath looks up a dotted path in a decoded JSON document. Numeric
+// segments index arrays.
+func jsonPath(doc any, path string) (any, bool) {
+	cur := doc
+	for _, seg := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case map[string]any:
+			next, ok := v[seg]
+			if !ok {
+				return nil, false
+			}
+			cur = next
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			cur = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// testFile is a file of hand-written test cases, in YAML or JSON.
+type testFile struct {
+	Tests []TestCase `yaml:"tests"`
+}
+
+// LoadTestFile reads hand-written test cases. Requests without a host are sent
+// to canonicalHost, and %%EMAIL%% is replaced by the email address as it is
+// in the site config's webfinger accounts.
+func LoadTestFile(path, canonicalHost, email string) ([]TestCase, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.ReplaceAll(data, []byte("%%EMAIL%%"), []byte(email))
+	var f testFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for i, t := range f.Tests {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: test %d has no name", path, i)
+		}
+		if t.Request.URI == "" {
+			return nil, fmt.Errorf("%s: test %s has no request uri", path, t.Name)
+		}
+		if t.MaxUtilization < 0 || t.MaxUtilization > 100 {
+			return nil, fmt.Errorf("%s: test %s: max_utilization must be between 0 and 100", path, t.Name)
+		}
+		if err := t.Expect.check(); err != nil {
+			return nil, fmt.Errorf("%s: test %s: %w", path, t.Name, err)
+		}
+		if t.Request.Host == "" {
+			f.Tests[i].Request.Host = canonicalHost
+		}
+	}
+	return f.Tests, nil
+}
+
+// functionTests returns the suite derived from the config followed by the
+// cases in the test file, if set.
+func functionTests(cfg *SiteConfig, email string, opts *functionTestOptions) ([]TestCase, error) {
+	if opts.Report != "" && opts.Report != reportJUnit && opts.Report != reportTAP {
+		return nil, fmt.Errorf("unknown report format %q", opts.Report)
+	}
+	tests := Suite(cfg, email)
+	if opts.File != "" {
+		fileTests, err := LoadTestFile(opts.File, cfg.CanonicalHost, email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tests: %w", err)
+		}
+		tests = append(tests, fileTests...)
+	}
+	return tests, nil
+}
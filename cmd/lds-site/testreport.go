@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Test report formats for CI display
+const (
+	reportJUnit = "junit"
+	reportTAP   = "tap"
+)
+
+// testResult is the outcome of running one test case.
+type testResult struct {
+	Name        string
+	Err         error  // nil if the test passed
+	Utilization string // Compute utilization reported by CloudFront
+	Previous    string // Compute utilization of the LIVE stage, if compared
+	Logs        []string
+}
+
+// utilizationSummary describes the compute utilization for reports.
+func (r testResult) utilizationSummary() string {
+	if r.Previous == "" {
+		return "compute utilization: " + r.Utilization
+	}
+	return fmt.Sprintf("compute utilization: %s (LIVE: %s)", r.Utilization, r.Previous)
+}
+
+// writeReport writes the results in the requested format, if any, to the
+// report file or stdout.
+func (o *functionTestOptions) writeReport(functionName string, results []testResult) error {
+	var write func(io.Writer, string, []testResult) error
+	switch o.Report {
+	case "":
+		return nil
+	case reportJUnit:
+		write = writeJUnitReport
+	case reportTAP:
+		write = writeTAPReport
+	default:
+		return fmt.Errorf("unknown report format %q", o.Report)
+	}
+
+	if o.ReportFile == "" {
+		return write(os.Stdout, functionName, results)
+	}
+	f, err := os.Create(o.ReportFile)
+	if err != nil {
+		return err
+	}
+	if err := write(f, functionName, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeJUnitReport(w io.Writer, functionName string, results []testResult) error {
+	suite := junitTestSuite{Name: functionName, Tests: len(results)}
+	for _, r := range results {
+		tc := junitTestCase{
+			Name:      r.Name,
+			ClassName: functionName,
+			SystemOut: r.utilizationSummary(),
+		}
+		if r.Err != nil {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: r.Err.Error(), Text: strings.Join(r.Logs, "\n")}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func writeTAPReport(w io.Writer, functionName string, results []testResult) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "TAP version 13\n1..%d\n", len(results))
+	for i, r := range results {
+		status := "ok"
+		if r.Err != nil {
+			status = "not ok"
+		}
+		fmt.Fprintf(&sb, "%s %d - %s\n", status, i+1, r.Name)
+		fmt.Fprintf(&sb, "# %s\n", r.utilizationSummary())
+		if r.Err == nil {
+			continue
+		}
+		// Diagnostics go in a YAML block after the failing test
+		fmt.Fprintf(&sb, "  ---\n  message: %q\n  function: %q\n", r.Err.Error(), functionName)
+		if len(r.Logs) > 0 {
+			sb.WriteString("  logs:\n")
+			for _, l := range r.Logs {
+				fmt.Fprintf(&sb, "    - %q\n", l)
+			}
+		}
+		sb.WriteString("  ...\n")
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront"
+	"github.com/aws/aws-sdk-go-v2/service/cloudfront/types"
+)
+
+// checkBudget returns an error if utilization is over the test's budget, or
+// the suite-wide one if the test doesn't set its own. CloudFront reports
+// utilization as a percentage of the maximum allowed, and throttles functions
+// that run close to it.
+func (o *functionTestOptions) checkBudget(tc TestCase, utilization string) error {
+	budget := tc.MaxUtilization
+	if budget == 0 {
+		budget = o.MaxUtilization
+	}
+	if budget <= 0 {
+		return nil
+	}
+	u, err := strconv.Atoi(utilization)
+	if err != nil {
+		// Nothing to enforce if CloudFront didn't report it
+		return nil
+	}
+	if u > budget {
+		return fmt.Errorf("compute utilization %d%% is over the budget of %d%%", u, budget)
+	}
+	return nil
+}
+
+// compareLive runs the tests against the LIVE stage, i.e. the previous deploy,
+// and records its utilization alongside the DEVELOPMENT results.
+func compareLive(ctx context.Context, client *cloudfront.Client, name string, tests []TestCase, results []testResult, logger *slog.Logger) error {
+	descOut, err := client.DescribeFunction(ctx, &cloudfront.DescribeFunctionInput{
+		Name:  &name,
+		Stage: types.FunctionStageLive,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe LIVE function: %w", err)
+	}
+
+	for i, tc := range tests {
+		res, err := runTest(ctx, client, name, *descOut.ETag, types.FunctionStageLive, tc)
+		if err != nil {
+			return err
+		}
+		results[i].Previous = res.Utilization
+
+		args := []any{"name", tc.Name, "live", res.Utilization, "development", results[i].Utilization}
+		if delta, ok := utilizationDelta(res.Utilization, results[i].Utilization); ok {
+			args = append(args, "change", fmt.Sprintf("%+d", delta))
+		}
+		logger.Info("Compute utilization", args...)
+	}
+	return nil
+}
+
+// summarizeUtilization logs the highest utilization across the suite.
+func summarizeUtilization(results []testResult, logger *slog.Logger) {
+	maxDev, maxLive := -1, -1
+	for _, r := range results {
+		if u, err := strconv.Atoi(r.Utilization); err == nil && u > maxDev {
+			maxDev = u
+		}
+		if u, err := strconv.Atoi(r.Previous); err == nil && u > maxLive {
+			maxLive = u
+		}
+	}
+	if maxDev < 0 {
+		return
+	}
+	args := []any{"max_development", maxDev}
+	if maxLive >= 0 {
+		args = append(args, "max_live", maxLive, "change", fmt.Sprintf("%+d", maxDev-maxLive))
+	}
+	logger.Info("Compute utilization summary", args...)
+}
+
+func utilizationDelta(before, after string) (int, bool) {
+	b, err := strconv.Atoi(before)
+	if err != nil {
+		return 0, false
+	}
+	a, err := strconv.Atoi(after)
+	if err != nil {
+		return 0, false
+	}
+	return a - b, true
+}
@@ -0,0 +1,254 @@
+// Package email obfuscates contact details such as email addresses on static
+// pages. Each value is encrypted with a key that can only be recovered by
+// completing a proof of work, which visitors' browsers do with WebCrypto.
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+)
+
+// Work functions a visitor's browser runs for each proof of work attempt. Both
+// are available through WebCrypto, so the template script can match them.
+const (
+	// WorkSHA256 hashes the challenge and candidate key with a single SHA-256.
+	WorkSHA256 = "sha256"
+	// WorkPBKDF2 runs PBKDF2-HMAC-SHA256 over the candidate key, salted with
+	// the challenge, making each attempt cost Iterations hash rounds.
+	WorkPBKDF2 = "pbkdf2-sha256"
+)
+
+// Options tunes the proof of work protecting each value
+type Options struct {
+	// DifficultyBits is the number of leading zero bits the work output must
+	// have. Each extra bit doubles the expected number of attempts.
+	DifficultyBits int
+	// Work is the work function, WorkSHA256 or WorkPBKDF2.
+	Work string
+	// Iterations is the PBKDF2 iteration count, ignored for WorkSHA256.
+	Iterations int
+	// MaxAttempts caps the proof of work search. If zero, it defaults to 64
+	// times the expected number of attempts for the difficulty.
+	MaxAttempts int
+	// Seed, if set, is a build secret from which the challenge and nonce are
+	// derived together with the value, instead of being random. The output is
+	// then stable across builds until the seed or value changes.
+	Seed []byte
+}
+
+// ErrMaxAttempts is returned when no proof of work solution is found within
+// Options.MaxAttempts attempts.
+var ErrMaxAttempts = errors.New("proof of work attempt limit reached")
+
+// DefaultOptions are used for any unset fields in Options
+var DefaultOptions = Options{
+	DifficultyBits: 16,
+	Work:           WorkSHA256,
+	Iterations:     1000,
+}
+
+// Validate checks that the options describe a supported proof of work
+func (o Options) Validate() error {
+	o = o.withDefaults()
+	if o.DifficultyBits < 1 || o.DifficultyBits > 32 {
+		return fmt.Errorf("difficulty must be between 1 and 32 bits, got %d", o.DifficultyBits)
+	}
+	switch o.Work {
+	case WorkSHA256:
+	case WorkPBKDF2:
+		if o.Iterations < 1 {
+			return fmt.Errorf("pbkdf2 iterations must be positive, got %d", o.Iterations)
+		}
+	default:
+		return fmt.Errorf("unknown work function %q", o.Work)
+	}
+	if o.MaxAttempts < 1 {
+		return fmt.Errorf("max attempts must be positive, got %d", o.MaxAttempts)
+	}
+	return nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.DifficultyBits == 0 {
+		o.DifficultyBits = DefaultOptions.DifficultyBits
+	}
+	if o.Work == "" {
+		o.Work = DefaultOptions.Work
+	}
+	if o.Iterations == 0 {
+		o.Iterations = DefaultOptions.Iterations
+	}
+	// The default cap depends on the difficulty, so it is left unset for
+	// Validate to reject if the difficulty is out of range
+	if o.MaxAttempts == 0 && o.DifficultyBits >= 1 && o.DifficultyBits <= 32 {
+		o.MaxAttempts = 64 << o.DifficultyBits
+	}
+	return o
+}
+
+// Data represents the data the client script needs to reveal one protected
+// value. It is embedded in templates as JSON.
+type Data struct {
+	Ciphertext     string `json:"ciphertext"`
+	Challenge      string `json:"challenge"`
+	DifficultyBits int    `json:"difficultyBits"`
+	Work           string `json:"work"`
+	Iterations     int    `json:"iterations"`
+}
+
+// GenerateSet protects a set of named values, such as email addresses, phone
+// numbers or chat handles. Each gets its own challenge, so revealing one does
+// not reveal the others.
+func GenerateSet(ctx context.Context, values map[string]string, opts Options) (map[string]Data, error) {
+	set := make(map[string]Data, len(values))
+	for name, value := range values {
+		d, err := GenerateData(ctx, value, opts)
+		if err != nil {
+			return nil, fmt.Errorf("generating %s: %w", name, err)
+		}
+		set[name] = d
+	}
+	return set, nil
+}
+
+// GenerateData creates the encrypted data for a single value. The proof of
+// work search stops when ctx is cancelled or Options.MaxAttempts is reached.
+func GenerateData(ctx context.Context, value string, opts Options) (Data, error) {
+	if err := opts.Validate(); err != nil {
+		return Data{}, err
+	}
+	opts = opts.withDefaults()
+
+	rnd := rand.Reader
+	if len(opts.Seed) > 0 {
+		var err error
+		rnd, err = seededReader(opts.Seed, value)
+		if err != nil {
+			return Data{}, err
+		}
+	}
+	challenge, err := generateChallenge(rnd)
+	if err != nil {
+		return Data{}, err
+	}
+	key, err := findProofOfWorkKey(ctx, challenge, opts)
+	if err != nil {
+		return Data{}, err
+	}
+	ciphertext, err := encryptValue(value, key, rnd)
+	if err != nil {
+		return Data{}, err
+	}
+
+	return Data{
+		Ciphertext:     ciphertext,
+		Challenge:      challenge,
+		DifficultyBits: opts.DifficultyBits,
+		Work:           opts.Work,
+		Iterations:     opts.Iterations,
+	}, nil
+}
+
+// seededReader returns a deterministic source of the bytes GenerateData needs,
+// derived from seed and value with HKDF. It holds enough for one challenge and
+// one GCM nonce.
+func seededReader(seed []byte, value string) (io.Reader, error) {
+	b, err := hkdf.Key(sha256.New, seed, nil, "lds.li email obfuscation\x00"+value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("deriving seeded randomness: %w", err)
+	}
+	return bytes.NewReader(b), nil
+}
+
+// generateChallenge creates a challenge string from rnd
+func generateChallenge(rnd io.Reader) (string, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(rnd, b); err != nil {
+		return "", fmt.Errorf("generating challenge: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// findProofOfWorkKey searches candidate keys "0", "1", ... for the first whose
+// work output has the required leading zero bits, and returns that output.
+func findProofOfWorkKey(ctx context.Context, challenge string, opts Options) ([]byte, error) {
+	for i := 0; i < opts.MaxAttempts; i++ {
+		if i%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		out, err := work(challenge, strconv.Itoa(i), opts)
+		if err != nil {
+			return nil, err
+		}
+		if leadingZeroBits(out) >= opts.DifficultyBits {
+			return out, nil
+		}
+	}
+	return nil, ErrMaxAttempts
+}
+
+// work runs the configured work function for one candidate key
+func work(challenge, candidate string, opts Options) ([]byte, error) {
+	switch opts.Work {
+	case WorkPBKDF2:
+		out, err := pbkdf2.Key(sha256.New, candidate, []byte(challenge), opts.Iterations, sha256.Size)
+		if err != nil {
+			return nil, fmt.Errorf("running pbkdf2: %w", err)
+		}
+		return out, nil
+	default:
+		hash := sha256.Sum256([]byte(challenge + candidate))
+		return hash[:], nil
+	}
+}
+
+// leadingZeroBits counts the zero bits at the start of b
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// encryptValue encrypts a value using AES-GCM, keyed by the SHA-256 of the
+// proof of work output. Deriving the key from the work output rather than the
+// candidate key means guessing keys costs as much as doing the work.
+func encryptValue(value string, workOutput []byte, rnd io.Reader) (string, error) {
+	keyHash := sha256.Sum256(workOutput)
+
+	block, err := aes.NewCipher(keyHash[:])
+	if err != nil {
+		return "", fmt.Errorf("creating cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("creating GCM: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rnd, nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(value), nil)
+	return hex.EncodeToString(ciphertext), nil
+}
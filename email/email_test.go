@@ -0,0 +1,220 @@
+package email
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// vectorSeed makes GenerateData deterministic, so the vectors below are fixed.
+var vectorSeed = []byte("lds.li test vector seed")
+
+// vectors are the seeded outputs for "me@example.com". A change to them means
+// pages generated from the same seed no longer match earlier builds.
+var vectors = []struct {
+	name       string
+	opts       Options
+	challenge  string
+	ciphertext string
+}{
+	{
+		name:       "sha256",
+		opts:       Options{DifficultyBits: 8, Work: WorkSHA256, Seed: vectorSeed},
+		challenge:  "87330e390e28e458",
+		ciphertext: "95bdf6b7fafe212cbe924143f6d79de4c58ec9c9b19c6e7fdbabe54a3bd23c440719edcd09f2c764566e",
+	},
+	{
+		name:       "pbkdf2",
+		opts:       Options{DifficultyBits: 6, Work: WorkPBKDF2, Iterations: 50, Seed: vectorSeed},
+		challenge:  "87330e390e28e458",
+		ciphertext: "95bdf6b7fafe212cbe9241433e6a864cfa70c9d8cc6c13cc5e6c1ad89113f262d887f9401de1f8071619",
+	},
+}
+
+func TestRevealVectors(t *testing.T) {
+	for _, tc := range vectors {
+		t.Run(tc.name, func(t *testing.T) {
+			const value = "me@example.com"
+			data, err := GenerateData(context.Background(), value, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Challenge != tc.challenge || data.Ciphertext != tc.ciphertext {
+				t.Fatalf("seeded output changed: got challenge %s ciphertext %s", data.Challenge, data.Ciphertext)
+			}
+
+			got, err := Reveal(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != value {
+				t.Fatalf("Reveal = %q, want %q", got, value)
+			}
+		})
+	}
+}
+
+// TestPageScriptAgrees runs the reveal script from the site template, with
+// WebCrypto backed by Go's crypto, and checks it does the same work and
+// recovers the same value as this package.
+func TestPageScriptAgrees(t *testing.T) {
+	script := pageScript(t)
+
+	for _, tc := range vectors {
+		t.Run(tc.name, func(t *testing.T) {
+			const value = "me@example.com"
+			data, err := GenerateData(context.Background(), value, tc.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secrets, err := json.Marshal(map[string]Data{"email": data})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vm := newScriptRuntime(t)
+			if _, err := vm.RunString(strings.Replace(script, "{{.Secrets}}", string(secrets), 1)); err != nil {
+				t.Fatalf("page script fails to load: %v", err)
+			}
+
+			opts := tc.opts.withDefaults()
+			for _, candidate := range []string{"0", "1", "42"} {
+				want, err := work(data.Challenge, candidate, opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = vm.RunString(`__out = undefined; work(secrets.email, ` + jsString(candidate) + `).then(out => {
+					__out = { hex: __hex(out), zeros: leadingZeroBits(out) };
+				});`)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out := vm.Get("__out").ToObject(vm)
+				if got := out.Get("hex").String(); got != hex.EncodeToString(want) {
+					t.Errorf("JS work(%s) = %s, Go = %x", candidate, got, want)
+				}
+				if got := out.Get("zeros").ToInteger(); got != int64(leadingZeroBits(want)) {
+					t.Errorf("JS leadingZeroBits(%s) = %d, Go = %d", candidate, got, leadingZeroBits(want))
+				}
+			}
+
+			if _, err := vm.RunString(`__out = undefined; revealSecret(secrets.email).then(v => { __out = v; });`); err != nil {
+				t.Fatal(err)
+			}
+			if got := vm.Get("__out").String(); got != value {
+				t.Fatalf("JS revealSecret = %q, want %q", got, value)
+			}
+		})
+	}
+}
+
+// pageScript returns the inline script of the site template that holds the
+// secrets.
+func pageScript(t *testing.T) string {
+	t.Helper()
+	page, err := os.ReadFile("../templates/index.tmpl.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range strings.Split(string(page), "<script>")[1:] {
+		script, _, ok := strings.Cut(block, "</script>")
+		if ok && strings.Contains(script, "const secrets = {{.Secrets}}") {
+			return script
+		}
+	}
+	t.Fatal("secrets script not found in template")
+	return ""
+}
+
+// newScriptRuntime returns a JS runtime with the browser APIs the page script
+// uses: TextEncoder, TextDecoder, the WebCrypto calls it makes and an inert
+// document.
+func newScriptRuntime(t *testing.T) *goja.Runtime {
+	t.Helper()
+	vm := goja.New()
+	buf := func(b []byte) goja.Value { return vm.ToValue(vm.NewArrayBuffer(b)) }
+	fail := func(err error) { panic(vm.NewGoError(err)) }
+
+	vm.Set("__utf8", func(s string) goja.Value { return buf([]byte(s)) })
+	vm.Set("__str", func(b []byte) string { return string(b) })
+	vm.Set("__sha256", func(b []byte) goja.Value {
+		sum := sha256.Sum256(b)
+		return buf(sum[:])
+	})
+	vm.Set("__pbkdf2", func(password, salt []byte, iterations, bitLen int) goja.Value {
+		out, err := pbkdf2.Key(sha256.New, string(password), salt, iterations, bitLen/8)
+		if err != nil {
+			fail(err)
+		}
+		return buf(out)
+	})
+	vm.Set("__aesgcm", func(key, iv, ciphertext []byte) goja.Value {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			fail(err)
+		}
+		gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+		if err != nil {
+			fail(err)
+		}
+		plain, err := gcm.Open(nil, iv, ciphertext, nil)
+		if err != nil {
+			fail(err)
+		}
+		return buf(plain)
+	})
+
+	_, err := vm.RunString(`
+		var __out;
+		function __bytes(x) {
+			return Array.prototype.slice.call(x instanceof ArrayBuffer ? new Uint8Array(x) : x);
+		}
+		function __hex(x) {
+			return __bytes(x).map(b => (b < 16 ? "0" : "") + b.toString(16)).join("");
+		}
+		function __async(f) {
+			return function () {
+				var args = arguments;
+				return new Promise(resolve => resolve(f.apply(null, args)));
+			};
+		}
+		function TextEncoder() {}
+		TextEncoder.prototype.encode = function (s) { return new Uint8Array(__utf8(s)); };
+		function TextDecoder() {}
+		TextDecoder.prototype.decode = function (b) { return __str(__bytes(b)); };
+		var crypto = { subtle: {
+			digest: __async((alg, data) => {
+				if (alg !== "SHA-256") throw new Error("unsupported digest " + alg);
+				return __sha256(__bytes(data));
+			}),
+			importKey: __async((format, raw, alg) => ({ raw: __bytes(raw), alg: alg.name || alg })),
+			deriveBits: __async((params, key, bitLen) => {
+				if (params.name !== "PBKDF2" || params.hash !== "SHA-256") throw new Error("unsupported derivation");
+				return __pbkdf2(key.raw, __bytes(params.salt), params.iterations, bitLen);
+			}),
+			decrypt: __async((params, key, data) => {
+				if (params.name !== "AES-GCM" || key.alg !== "AES-GCM") throw new Error("unsupported cipher");
+				return __aesgcm(key.raw, __bytes(params.iv), __bytes(data));
+			}),
+		} };
+		var document = { readyState: "loading", addEventListener: function () {} };
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vm
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,56 @@
+package email
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Reveal recovers the value protected by data, following the same steps as the
+// browser script: search candidate keys from "0" upwards for a work output with
+// enough leading zero bits, then decrypt with the SHA-256 of that output. It
+// exists to check that what GenerateData produces can actually be revealed.
+func Reveal(data Data) (string, error) {
+	opts := Options{
+		DifficultyBits: data.DifficultyBits,
+		Work:           data.Work,
+		Iterations:     data.Iterations,
+	}
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	opts = opts.withDefaults()
+
+	workOutput, err := findProofOfWorkKey(context.Background(), data.Challenge, opts)
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := hex.DecodeString(data.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("decoding ciphertext: %w", err)
+	}
+
+	keyHash := sha256.Sum256(workOutput)
+	block, err := aes.NewCipher(keyHash[:])
+	if err != nil {
+		return "", fmt.Errorf("creating cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", fmt.Errorf("creating GCM: %w", err)
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decrypting: %w", err)
+	}
+	return string(plaintext), nil
+}